@@ -0,0 +1,739 @@
+package services
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancer is an interface implemented by load balancing strategies, which
+// decide which of the addresses of a service are returned by resolvers like
+// Cache.
+//
+// Balancers do not pick addresses themselves, they create a Picker for each
+// set of addresses of a service. The picker holds the state of the balancing
+// strategy for this set of addresses (like the position of a round robin),
+// it is retained by the resolver as long as the set of addresses does not
+// change, then released if it implements PickerReleaser.
+//
+// Balancer implementations must be safe to use concurrently from multiple
+// goroutines.
+type Balancer interface {
+	// NewPicker returns a picker distributing load across addrs, which is the
+	// non-empty list of addresses of the service with the given name.
+	//
+	// When the addresses of a service change, prev is the picker that was
+	// used for the previous set of addresses, which implementations may carry
+	// state over from, otherwise prev is nil.
+	//
+	// The list of addresses must not be modified by the picker.
+	NewPicker(name string, addrs []string, prev Picker) Picker
+}
+
+// WeightedBalancer is an interface implemented by balancers which take into
+// account the weights of addresses exposed by registries implementing the
+// EndpointRegistry interface.
+type WeightedBalancer interface {
+	Balancer
+
+	// NewWeightedPicker is like NewPicker, weights holds the weight of each
+	// address in addrs, which is always greater than zero.
+	NewWeightedPicker(name string, addrs []string, weights []int, prev Picker) Picker
+}
+
+// Picker is an interface implemented by types that pick an address from a set
+// of addresses, as part of a load balancing strategy.
+//
+// Picker implementations must be safe to use concurrently from multiple
+// goroutines.
+type Picker interface {
+	// Pick returns one of the addresses that the picker was created for.
+	//
+	// The context is the one passed to the resolver, implementations may use
+	// it to carry values which influence the selection.
+	Pick(ctx context.Context) string
+}
+
+// PickerReleaser is an interface implemented by pickers which hold state shared
+// with their balancer, like the pickers of LeastLoaded and PeakEWMA.
+//
+// Resolvers like Cache and RegistryResolver call Release when they stop using a
+// picker, because the addresses of the service changed or the cache entry was
+// evicted. Goroutines which loaded the picker before may still call Pick after
+// it was released, and Release may be called more than once.
+type PickerReleaser interface {
+	Picker
+
+	// Release lets the balancer discard the state that the picker holds.
+	Release()
+}
+
+// RoundRobin is a Balancer which returns the addresses of a service one after
+// the other, in a random order.
+type RoundRobin struct{}
+
+// NewPicker satisfies the Balancer interface.
+func (RoundRobin) NewPicker(name string, addrs []string, prev Picker) Picker {
+	return &roundRobinPicker{addrs: shuffledStrings(addrs)}
+}
+
+type roundRobinPicker struct {
+	index uint64
+	addrs []string
+}
+
+func (p *roundRobinPicker) Pick(ctx context.Context) string {
+	i := atomic.AddUint64(&p.index, +1)
+	return p.addrs[i%uint64(len(p.addrs))]
+}
+
+// Random is a Balancer which returns addresses of a service picked uniformly
+// at random.
+type Random struct{}
+
+// NewPicker satisfies the Balancer interface.
+func (Random) NewPicker(name string, addrs []string, prev Picker) Picker {
+	return randomPicker(addrs)
+}
+
+type randomPicker []string
+
+func (p randomPicker) Pick(ctx context.Context) string {
+	return p[rand.Intn(len(p))]
+}
+
+// WeightedRandom is a Balancer which returns addresses of a service picked at
+// random, with a probability proportional to their weight.
+type WeightedRandom struct {
+	// Weight returns the weight of an address of the service with the given
+	// name. Addresses with a zero or negative weight are never returned, unless
+	// all addresses of the service have one, in which case they are picked
+	// uniformly. If nil, the weights exposed by the registry are used, or all
+	// addresses have the same weight.
+	Weight func(name string, addr string) float64
+}
+
+// NewWeightedPicker satisfies the WeightedBalancer interface.
+func (b WeightedRandom) NewWeightedPicker(name string, addrs []string, weights []int, prev Picker) Picker {
+	if b.Weight != nil {
+		return b.NewPicker(name, addrs, prev)
+	}
+
+	p := &weightedRandomPicker{
+		addrs: addrs,
+		sums:  make([]float64, len(addrs)),
+	}
+
+	for i, w := range weights {
+		p.total += float64(w)
+		p.sums[i] = p.total
+	}
+
+	return p
+}
+
+// NewPicker satisfies the Balancer interface.
+func (b WeightedRandom) NewPicker(name string, addrs []string, prev Picker) Picker {
+	if b.Weight == nil {
+		return randomPicker(addrs)
+	}
+
+	p := &weightedRandomPicker{}
+
+	for _, addr := range addrs {
+		if w := b.Weight(name, addr); w > 0 {
+			p.total += w
+			p.addrs = append(p.addrs, addr)
+			p.sums = append(p.sums, p.total)
+		}
+	}
+
+	if len(p.addrs) == 0 {
+		return randomPicker(addrs)
+	}
+
+	return p
+}
+
+type weightedRandomPicker struct {
+	addrs []string
+	sums  []float64 // cumulative weights
+	total float64
+}
+
+func (p *weightedRandomPicker) Pick(ctx context.Context) string {
+	i := sort.SearchFloat64s(p.sums, rand.Float64()*p.total)
+	if i == len(p.addrs) { // rounding errors
+		i--
+	}
+	return p.addrs[i]
+}
+
+// WeightedRoundRobin is a Balancer which returns the addresses of a service in
+// turn, each address being returned a number of times proportional to its
+// weight, as exposed by registries implementing EndpointRegistry.
+//
+// The balancer implements the smooth weighted round robin algorithm of nginx,
+// which interleaves the addresses instead of returning the same address
+// multiple times in a row. For example, with weights {a: 5, b: 1, c: 1}, the
+// addresses are returned in the order a, a, b, a, c, a, a.
+type WeightedRoundRobin struct {
+	// Weight returns the weight of an address of the service with the given
+	// name. If nil, the weights exposed by the registry are used, or all
+	// addresses have the same weight. Weights lower than 1 are set to 1.
+	Weight func(name string, addr string) int
+}
+
+// NewPicker satisfies the Balancer interface.
+func (b WeightedRoundRobin) NewPicker(name string, addrs []string, prev Picker) Picker {
+	return b.NewWeightedPicker(name, addrs, nil, prev)
+}
+
+// NewWeightedPicker satisfies the WeightedBalancer interface.
+func (b WeightedRoundRobin) NewWeightedPicker(name string, addrs []string, weights []int, prev Picker) Picker {
+	p := &weightedRoundRobinPicker{
+		addrs:   addrs,
+		weights: make([]int, len(addrs)),
+		current: make([]int, len(addrs)),
+	}
+
+	for i, addr := range addrs {
+		w := 1
+		switch {
+		case b.Weight != nil:
+			w = b.Weight(name, addr)
+		case weights != nil:
+			w = weights[i]
+		}
+		if w < 1 {
+			w = 1
+		}
+		p.weights[i] = w
+		p.total += w
+	}
+
+	// Carry over the position of addresses that were already in the previous
+	// picker, so changes to the set of addresses don't reset the rotation.
+	if prev, ok := prev.(*weightedRoundRobinPicker); ok {
+		prev.mutex.Lock()
+		current := make(map[string]int, len(prev.addrs))
+		for i, addr := range prev.addrs {
+			current[addr] = prev.current[i]
+		}
+		prev.mutex.Unlock()
+
+		for i, addr := range addrs {
+			p.current[i] = current[addr]
+		}
+	}
+
+	return p
+}
+
+type weightedRoundRobinPicker struct {
+	mutex   sync.Mutex
+	addrs   []string
+	weights []int
+	current []int
+	total   int
+}
+
+func (p *weightedRoundRobinPicker) Pick(ctx context.Context) string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	best := 0
+
+	for i, w := range p.weights {
+		p.current[i] += w
+		if p.current[i] > p.current[best] {
+			best = i
+		}
+	}
+
+	p.current[best] -= p.total
+	return p.addrs[best]
+}
+
+// LeastLoaded is a Balancer which tracks the number of connections (or
+// requests) in flight to each address, and picks the least loaded of two
+// addresses chosen at random (the "power of two choices").
+//
+// When used by a Cache or RegistryResolver given to a Dialer, connections are
+// tracked from the time they are established until they are closed. Programs
+// may also track requests by calling Track.
+//
+// LeastLoaded values must not be copied after being used, and the same value
+// may be shared by resolvers of different services. The pickers of the
+// balancer implement PickerReleaser.
+type LeastLoaded struct {
+	loads addrTable
+}
+
+// NewPicker satisfies the Balancer interface.
+func (b *LeastLoaded) NewPicker(name string, addrs []string, prev Picker) Picker {
+	return &leastLoadedPicker{
+		balancer: b,
+		addrs:    addrs,
+		loads:    b.loads.acquire(addrs),
+	}
+}
+
+// Track increments the load of addr, the returned function must be called to
+// decrement it when the connection or request completes.
+func (b *LeastLoaded) Track(addr string) (done func()) {
+	return b.loads.track(addr)
+}
+
+// ObserveDial satisfies the DialObserver interface.
+func (b *LeastLoaded) ObserveDial(name string, addr string, rtt time.Duration, err error) func() {
+	if err != nil {
+		return nil
+	}
+	return b.Track(addr)
+}
+
+type leastLoadedPicker struct {
+	balancer *LeastLoaded
+	addrs    []string
+	loads    []*addrEntry
+	release  sync.Once
+}
+
+func (p *leastLoadedPicker) Release() {
+	p.release.Do(func() { p.balancer.loads.release(p.loads) })
+}
+
+func (p *leastLoadedPicker) Pick(ctx context.Context) string {
+	n := len(p.addrs)
+	if n == 1 {
+		return p.addrs[0]
+	}
+
+	i, j := twoChoices(n)
+
+	if atomic.LoadInt64(&p.loads[j].pending) < atomic.LoadInt64(&p.loads[i].pending) {
+		i = j
+	}
+
+	return p.addrs[i]
+}
+
+// PeakEWMA is a Balancer which tracks the latency of each address in a moving
+// average, and picks the address with the lowest cost of two addresses chosen
+// at random. The cost of an address is its average latency multiplied by the
+// number of connections (or requests) in flight to it, plus one.
+//
+// The average is sensitive to peaks: an observed latency higher than the
+// average replaces it, while lower latencies are blended in exponentially. Over
+// time, the cost of addresses which are not picked decays, so they are tried
+// again eventually. Errors are recorded as a latency equal to Penalty. The
+// latency of addresses that were never observed is the mean latency of the
+// other addresses of the service, so new addresses receive their share of the
+// load without being preferred until their first connection completes.
+//
+// When used by a Cache or RegistryResolver given to a Dialer, the time it
+// takes to establish connections is recorded automatically, and connections
+// are tracked until they are closed. Programs may also report the latency of
+// requests by calling Observe, and track them by calling Track.
+//
+// PeakEWMA values must not be copied after being used, and the same value may
+// be shared by resolvers of different services. The pickers of the balancer
+// implement PickerReleaser.
+type PeakEWMA struct {
+	// Time it takes for the weight of a latency observation to decrease by a
+	// factor of e. Defaults to 10 seconds.
+	Decay time.Duration
+
+	// Latency recorded when errors occur. Defaults to 1 second.
+	Penalty time.Duration
+
+	addrs addrTable
+}
+
+// NewPicker satisfies the Balancer interface.
+func (b *PeakEWMA) NewPicker(name string, addrs []string, prev Picker) Picker {
+	return &peakEWMAPicker{
+		balancer: b,
+		addrs:    addrs,
+		stats:    b.addrs.acquire(addrs),
+	}
+}
+
+// Observe records the latency of a connection or request to addr. If err is
+// not nil, the latency is ignored and the penalty is recorded instead.
+//
+// Latencies of addresses which are not referenced by pickers of the balancer
+// that were not released, and have no connections or requests in flight, are
+// discarded.
+func (b *PeakEWMA) Observe(addr string, rtt time.Duration, err error) {
+	if err != nil {
+		rtt = b.penalty()
+	}
+	b.addrs.with(addr, func(e *addrEntry) {
+		e.observe(float64(rtt), b.decay(), time.Now())
+	})
+}
+
+// Track increments the number of connections or requests in flight to addr,
+// the returned function must be called to decrement it when the connection or
+// request completes.
+func (b *PeakEWMA) Track(addr string) (done func()) {
+	return b.addrs.track(addr)
+}
+
+// ObserveDial satisfies the DialObserver interface.
+func (b *PeakEWMA) ObserveDial(name string, addr string, rtt time.Duration, err error) func() {
+	b.Observe(addr, rtt, err)
+	if err != nil {
+		return nil
+	}
+	return b.Track(addr)
+}
+
+func (b *PeakEWMA) decay() time.Duration {
+	if decay := b.Decay; decay > 0 {
+		return decay
+	}
+	return 10 * time.Second
+}
+
+func (b *PeakEWMA) penalty() time.Duration {
+	if penalty := b.Penalty; penalty > 0 {
+		return penalty
+	}
+	return 1 * time.Second
+}
+
+func (e *addrEntry) observe(rtt float64, decay time.Duration, now time.Time) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if rtt > e.value {
+		e.value = rtt
+	} else {
+		w := math.Exp(-float64(now.Sub(e.stamp)) / float64(decay))
+		e.value = e.value*w + rtt*(1-w)
+	}
+
+	e.stamp = now
+}
+
+// latency returns the moving average of latencies observed for the address,
+// decayed up to now, and false if no latencies were observed.
+func (e *addrEntry) latency(decay time.Duration, now time.Time) (float64, bool) {
+	e.mutex.Lock()
+	value, stamp := e.value, e.stamp
+	e.mutex.Unlock()
+
+	if stamp.IsZero() {
+		return 0, false
+	}
+
+	return value * math.Exp(-float64(now.Sub(stamp))/float64(decay)), true
+}
+
+type peakEWMAPicker struct {
+	balancer *PeakEWMA
+	addrs    []string
+	stats    []*addrEntry
+	release  sync.Once
+}
+
+func (p *peakEWMAPicker) Release() {
+	p.release.Do(func() { p.balancer.addrs.release(p.stats) })
+}
+
+func (p *peakEWMAPicker) Pick(ctx context.Context) string {
+	n := len(p.addrs)
+	if n == 1 {
+		return p.addrs[0]
+	}
+
+	i, j := twoChoices(n)
+
+	now := time.Now()
+	decay := p.balancer.decay()
+
+	if p.cost(p.stats[j], decay, now) < p.cost(p.stats[i], decay, now) {
+		i = j
+	}
+
+	return p.addrs[i]
+}
+
+// cost returns the latency of the address of e multiplied by the number of
+// connections or requests in flight to it, plus one. Addresses which were never
+// observed have the mean latency of the addresses of the picker.
+func (p *peakEWMAPicker) cost(e *addrEntry, decay time.Duration, now time.Time) float64 {
+	value, ok := e.latency(decay, now)
+	if !ok {
+		value = p.meanLatency(decay, now)
+	}
+	return value * float64(atomic.LoadInt64(&e.pending)+1)
+}
+
+// meanLatency returns the mean latency of the addresses of the picker which
+// were observed, or zero if none were.
+func (p *peakEWMAPicker) meanLatency(decay time.Duration, now time.Time) float64 {
+	sum, n := 0.0, 0
+
+	for _, e := range p.stats {
+		if value, ok := e.latency(decay, now); ok {
+			sum += value
+			n++
+		}
+	}
+
+	if n == 0 {
+		return 0
+	}
+
+	return sum / float64(n)
+}
+
+// RegistryResolver is an adapter which implements the Resolver interface on
+// top of a Registry, using a Balancer to pick one of the addresses returned by
+// the registry.
+//
+// Every call to Resolve makes a lookup on the registry, RegistryResolver is
+// usually combined with a Cache to avoid it. Pickers are retained for as long
+// as the addresses of a service do not change, then released.
+//
+// RegistryResolver values must not be copied after being used.
+type RegistryResolver struct {
+	// The registry to lookup addresses from. This field must not be nil.
+	Registry Registry
+
+	// The load balancing strategy used to pick addresses. Defaults to
+	// RoundRobin.
+	Balancer Balancer
+
+	mutex   sync.Mutex
+	pickers map[string]registryPicker
+}
+
+type registryPicker struct {
+	addrs   []string // sorted
+	weights map[string]int
+	picker  Picker
+}
+
+// Resolve satisfies the Resolver interface.
+func (r *RegistryResolver) Resolve(ctx context.Context, name string) (string, error) {
+	addrs, weights, _, err := lookupEndpoints(ctx, r.Registry, name)
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) == 0 {
+		return "", &registryResolverError{name: name}
+	}
+
+	addrs = sortedStrings(addrs)
+
+	var prev Picker
+
+	r.mutex.Lock()
+	p := r.pickers[name]
+	if !equalStrings(p.addrs, addrs) || !equalWeights(p.weights, weights) {
+		prev = p.picker
+		p = registryPicker{
+			addrs:   addrs,
+			weights: weights,
+			picker:  newPicker(r.Balancer, name, addrs, weights, prev),
+		}
+		if r.pickers == nil {
+			r.pickers = make(map[string]registryPicker)
+		}
+		r.pickers[name] = p
+	}
+	r.mutex.Unlock()
+
+	if prev != nil {
+		releasePicker(prev)
+	}
+
+	return p.picker.Pick(ctx), nil
+}
+
+// ObserveDial satisfies the DialObserver interface, it forwards the call to the
+// balancer if it implements the interface.
+func (r *RegistryResolver) ObserveDial(name string, addr string, rtt time.Duration, err error) func() {
+	return observeDial(r.Balancer, name, addr, rtt, err)
+}
+
+type registryResolverError struct {
+	name string
+}
+
+func (e *registryResolverError) Error() string {
+	return e.name + ": no results returned by the service registry"
+}
+
+func (e *registryResolverError) Unreachable() bool {
+	return true
+}
+
+// addrTable holds the state that balancers keep for each address, shared by the
+// pickers of all the services that the address belongs to.
+//
+// Pickers reference the entries of their addresses until they are released.
+// Entries which are not referenced by any picker are removed once no
+// connections or requests to their address are in flight, so the table does
+// not keep growing when addresses come and go.
+type addrTable struct {
+	mutex   sync.Mutex
+	entries map[string]*addrEntry
+}
+
+type addrEntry struct {
+	pending int64  // connections or requests in flight
+	refs    int    // pickers referencing the entry, guarded by the table mutex
+	addr    string // immutable
+
+	// moving average of latencies, used by PeakEWMA
+	mutex sync.Mutex
+	value float64 // nanoseconds
+	stamp time.Time
+}
+
+// acquire returns the entries of addrs, adding a reference to each of them. The
+// entries must be given back to release when they are not used anymore.
+func (t *addrTable) acquire(addrs []string) []*addrEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	entries := make([]*addrEntry, len(addrs))
+	for i, addr := range addrs {
+		e := t.entry(addr)
+		e.refs++
+		entries[i] = e
+	}
+
+	return entries
+}
+
+// with calls f with the entry of addr, which is removed afterwards if it is not
+// in use.
+func (t *addrTable) with(addr string, f func(*addrEntry)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	e := t.entry(addr)
+	f(e)
+	t.remove(e)
+}
+
+// release removes a reference to each of the entries, which were returned by
+// acquire.
+func (t *addrTable) release(entries []*addrEntry) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for _, e := range entries {
+		e.refs--
+		t.remove(e)
+	}
+}
+
+// track increments the number of connections or requests in flight to addr,
+// the returned function decrements it.
+func (t *addrTable) track(addr string) (done func()) {
+	t.mutex.Lock()
+	e := t.entry(addr)
+	atomic.AddInt64(&e.pending, +1)
+	t.mutex.Unlock()
+
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			if atomic.AddInt64(&e.pending, -1) == 0 {
+				t.mutex.Lock()
+				t.remove(e)
+				t.mutex.Unlock()
+			}
+		})
+	}
+}
+
+// entry returns the entry of addr, creating it if it does not exist. The table
+// mutex must be held.
+func (t *addrTable) entry(addr string) *addrEntry {
+	e := t.entries[addr]
+	if e == nil {
+		if t.entries == nil {
+			t.entries = make(map[string]*addrEntry)
+		}
+		e = &addrEntry{addr: addr}
+		t.entries[addr] = e
+	}
+	return e
+}
+
+// remove deletes e from the table if it is not in use anymore. The table mutex
+// must be held.
+func (t *addrTable) remove(e *addrEntry) {
+	if e.refs == 0 && atomic.LoadInt64(&e.pending) == 0 && t.entries[e.addr] == e {
+		delete(t.entries, e.addr)
+	}
+}
+
+// newPicker creates a picker for addrs using b, or the default balancer if b is
+// nil. The weights are given to the balancer if it implements WeightedBalancer
+// and weights is not nil.
+func newPicker(b Balancer, name string, addrs []string, weights map[string]int, prev Picker) Picker {
+	if b == nil {
+		b = RoundRobin{}
+	}
+	if wb, ok := b.(WeightedBalancer); ok && weights != nil {
+		return wb.NewWeightedPicker(name, addrs, weightsOf(addrs, weights), prev)
+	}
+	return b.NewPicker(name, addrs, prev)
+}
+
+// twoChoices returns two distinct random indexes lower than n, which must be
+// at least 2.
+func twoChoices(n int) (int, int) {
+	i := rand.Intn(n)
+	j := rand.Intn(n - 1)
+	if j >= i {
+		j++
+	}
+	return i, j
+}
+
+// releasePicker calls the Release method of p if it implements PickerReleaser.
+func releasePicker(p Picker) {
+	if r, ok := p.(PickerReleaser); ok {
+		r.Release()
+	}
+}
+
+func observeDial(b Balancer, name string, addr string, rtt time.Duration, err error) func() {
+	if o, ok := b.(DialObserver); ok {
+		return o.ObserveDial(name, addr, rtt, err)
+	}
+	return nil
+}
+
+// sameAddrs returns true if a and b contain the same set of addresses, in any
+// order.
+func sameAddrs(a, b []string) bool {
+	return len(a) == len(b) && len(diffStrings(a, b)) == 0 && len(diffStrings(b, a)) == 0
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,654 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBalancer(t *testing.T) {
+	balancers := []struct {
+		name     string
+		balancer Balancer
+	}{
+		{"round robin", RoundRobin{}},
+		{"random", Random{}},
+		{"weighted random", WeightedRandom{Weight: func(string, string) float64 { return 1 }}},
+		{"weighted round robin", WeightedRoundRobin{}},
+		{"least loaded", &LeastLoaded{}},
+		{"peak ewma", &PeakEWMA{}},
+	}
+
+	for _, b := range balancers {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("cache", func(t *testing.T) {
+				testResolver(t, func(services map[string][]string) (Resolver, func()) {
+					cache := &Cache{Registry: registry(services), Balancer: b.balancer}
+					return cache, func() { cache.Close() }
+				})
+			})
+
+			t.Run("registry resolver", func(t *testing.T) {
+				testResolver(t, func(services map[string][]string) (Resolver, func()) {
+					return &RegistryResolver{Registry: registry(services), Balancer: b.balancer}, func() {}
+				})
+			})
+		})
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	addrs := []string{"localhost:4000", "localhost:4001", "localhost:4002"}
+	picker := RoundRobin{}.NewPicker("my-service", addrs, nil)
+	counts := make(map[string]int)
+
+	for i := 0; i != 30; i++ {
+		counts[picker.Pick(context.Background())]++
+	}
+
+	for _, addr := range addrs {
+		if counts[addr] != 10 {
+			t.Errorf("%s was picked %d times instead of 10", addr, counts[addr])
+		}
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	weights := map[string]float64{
+		"localhost:4000": 1,
+		"localhost:4001": 3,
+		"localhost:4002": 0,
+	}
+
+	balancer := WeightedRandom{
+		Weight: func(name string, addr string) float64 { return weights[addr] },
+	}
+
+	picker := balancer.NewPicker("my-service", []string{
+		"localhost:4000",
+		"localhost:4001",
+		"localhost:4002",
+	}, nil)
+
+	const N = 10000
+	counts := make(map[string]int)
+
+	for i := 0; i != N; i++ {
+		counts[picker.Pick(context.Background())]++
+	}
+
+	if n := counts["localhost:4002"]; n != 0 {
+		t.Errorf("address with a zero weight was picked %d times", n)
+	}
+
+	if r := float64(counts["localhost:4001"]) / N; math.Abs(r-0.75) > 0.05 {
+		t.Errorf("address with 75%% of the weight was picked %.1f%% of the time", 100*r)
+	}
+}
+
+func TestWeightedRoundRobin(t *testing.T) {
+	t.Run("addresses are interleaved", func(t *testing.T) {
+		picker := WeightedRoundRobin{}.NewWeightedPicker("my-service", []string{"a", "b", "c"}, []int{5, 1, 1}, nil)
+		picks := make([]string, 14)
+
+		for i := range picks {
+			picks[i] = picker.Pick(context.Background())
+		}
+
+		if s := strings.Join(picks, ""); s != "aabacaaaabacaa" {
+			t.Error("bad sequence of addresses:", s)
+		}
+	})
+
+	t.Run("the weight function overrides the weights of the registry", func(t *testing.T) {
+		balancer := WeightedRoundRobin{
+			Weight: func(name string, addr string) int {
+				if addr == "b" {
+					return 2
+				}
+				return 1
+			},
+		}
+		picker := balancer.NewWeightedPicker("my-service", []string{"a", "b"}, []int{5, 1}, nil)
+		counts := make(map[string]int)
+
+		for i := 0; i != 3; i++ {
+			counts[picker.Pick(context.Background())]++
+		}
+
+		if counts["a"] != 1 || counts["b"] != 2 {
+			t.Error("bad distribution:", counts)
+		}
+	})
+
+	t.Run("the rotation is carried over when addresses change", func(t *testing.T) {
+		prev := WeightedRoundRobin{}.NewWeightedPicker("my-service", []string{"a", "b"}, []int{1, 1}, nil)
+		first := prev.Pick(context.Background())
+
+		next := WeightedRoundRobin{}.NewWeightedPicker("my-service", []string{"a", "b", "c"}, []int{1, 1, 1}, prev)
+		counts := make(map[string]int)
+
+		for i := 0; i != 3; i++ {
+			counts[next.Pick(context.Background())]++
+		}
+
+		if counts[first] != 1 || len(counts) != 3 {
+			t.Error("bad distribution after adding an address:", first, counts)
+		}
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		cache := &Cache{
+			Registry: endpointRegistry{
+				"my-service": {
+					{Addr: "localhost:4000", Weight: 3},
+					{Addr: "localhost:4001", Tags: []string{"weight=1"}},
+				},
+			},
+			Balancer: WeightedRoundRobin{},
+		}
+		defer cache.Close()
+
+		counts := make(map[string]int)
+
+		for i := 0; i != 8; i++ {
+			addr, err := cache.Resolve(context.Background(), "my-service")
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[addr]++
+		}
+
+		if counts["localhost:4000"] != 6 || counts["localhost:4001"] != 2 {
+			t.Error("bad distribution:", counts)
+		}
+	})
+
+	t.Run("registry resolver", func(t *testing.T) {
+		r := &RegistryResolver{
+			Registry: endpointRegistry{
+				"my-service": {
+					{Addr: "localhost:4000", Weight: 1},
+					{Addr: "localhost:4001", Weight: 2},
+				},
+			},
+			Balancer: WeightedRoundRobin{},
+		}
+
+		counts := make(map[string]int)
+
+		for i := 0; i != 6; i++ {
+			addr, err := r.Resolve(context.Background(), "my-service")
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[addr]++
+		}
+
+		if counts["localhost:4000"] != 2 || counts["localhost:4001"] != 4 {
+			t.Error("bad distribution:", counts)
+		}
+	})
+}
+
+func TestWeightedRandomEndpoints(t *testing.T) {
+	cache := &Cache{
+		Registry: endpointRegistry{
+			"my-service": {
+				{Addr: "localhost:4000", Weight: 1},
+				{Addr: "localhost:4001", Weight: 3},
+			},
+		},
+		Balancer: WeightedRandom{},
+	}
+	defer cache.Close()
+
+	const N = 10000
+	counts := make(map[string]int)
+
+	for i := 0; i != N; i++ {
+		addr, err := cache.Resolve(context.Background(), "my-service")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[addr]++
+	}
+
+	if r := float64(counts["localhost:4001"]) / N; math.Abs(r-0.75) > 0.05 {
+		t.Errorf("address with 75%% of the weight was picked %.1f%% of the time", 100*r)
+	}
+}
+
+func TestLeastLoaded(t *testing.T) {
+	b := &LeastLoaded{}
+	addrs := []string{"localhost:4000", "localhost:4001", "localhost:4002"}
+	picker := b.NewPicker("my-service", addrs, nil)
+
+	done1 := b.Track("localhost:4000")
+	done2 := b.Track("localhost:4001")
+
+	// The least loaded address is picked unless it is not one of the two
+	// random candidates, which happens a third of the time.
+	counts := make(map[string]int)
+	for i := 0; i != 3000; i++ {
+		counts[picker.Pick(context.Background())]++
+	}
+
+	if n := counts["localhost:4002"]; n < 1800 {
+		t.Errorf("the least loaded address was picked %d times out of 3000", n)
+	}
+
+	done1()
+	done1() // calling done multiple times must decrement the load once
+	done2()
+
+	for _, addr := range addrs {
+		if load := b.loads.pending(addr); load != 0 {
+			t.Errorf("%s has a load of %d after all requests completed", addr, load)
+		}
+	}
+}
+
+func TestAddrTable(t *testing.T) {
+	t.Run("entries of addresses which are not referenced by pickers are removed", func(t *testing.T) {
+		b := &LeastLoaded{}
+		p1 := b.NewPicker("my-service", testAddrs(2), nil)
+		p2 := b.NewPicker("my-service", testAddrs(3)[1:], p1)
+		releasePicker(p1)
+
+		if n := b.loads.size(); n != 2 {
+			t.Errorf("bad number of entries after releasing the first picker: %d", n)
+		}
+
+		releasePicker(p2)
+		releasePicker(p2) // releasing pickers multiple times must be a no-op
+
+		if n := b.loads.size(); n != 0 {
+			t.Errorf("%d entries remain after pickers were released", n)
+		}
+	})
+
+	t.Run("latencies of addresses which are not referenced by pickers are discarded", func(t *testing.T) {
+		b := &PeakEWMA{}
+		b.NewPicker("my-service", []string{"localhost:4001"}, nil)
+		b.Observe("localhost:4000", time.Millisecond, nil)
+		b.Observe("localhost:4001", time.Millisecond, nil)
+
+		if n := b.addrs.size(); n != 1 {
+			t.Errorf("bad number of entries: %d", n)
+		}
+	})
+
+	t.Run("entries are released when the cache evicts entries or their addresses change", func(t *testing.T) {
+		b := &LeastLoaded{}
+		services := registry{"service-1": {"localhost:4000"}, "service-2": {"localhost:4001"}}
+		mutex := sync.Mutex{}
+
+		cache := &Cache{
+			Registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				addrs, _, err := services.Lookup(ctx, name, tags...)
+				return addrs, 10 * time.Millisecond, err
+			}),
+			Balancer: b,
+		}
+		defer cache.Close()
+
+		cache.Resolve(context.Background(), "service-1")
+		cache.Resolve(context.Background(), "service-2")
+
+		if n := b.loads.size(); n != 2 {
+			t.Errorf("bad number of entries: %d", n)
+		}
+
+		mutex.Lock()
+		services["service-1"] = []string{"localhost:4002"}
+		mutex.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		cache.Resolve(context.Background(), "service-1")
+
+		if n := b.loads.size(); n != 2 {
+			t.Errorf("bad number of entries after the addresses changed: %d", n)
+		}
+
+		cache.Invalidate("service-2")
+
+		if n := b.loads.size(); n != 1 {
+			t.Errorf("bad number of entries after the cache entry was evicted: %d", n)
+		}
+	})
+
+	t.Run("entries are released when the registry resolver replaces pickers", func(t *testing.T) {
+		b := &LeastLoaded{}
+		services := registry{"my-service": {"localhost:4000"}}
+		r := &RegistryResolver{Registry: services, Balancer: b}
+
+		r.Resolve(context.Background(), "my-service")
+		services["my-service"] = []string{"localhost:4001"}
+		r.Resolve(context.Background(), "my-service")
+
+		if n := b.loads.size(); n != 1 {
+			t.Errorf("bad number of entries: %d", n)
+		}
+	})
+
+	t.Run("entries are kept while connections are in flight", func(t *testing.T) {
+		table := &addrTable{}
+		entries := table.acquire([]string{"localhost:4000"})
+		done := table.track("localhost:4000")
+
+		table.release(entries)
+		if n := table.size(); n != 1 {
+			t.Error("the entry was removed while a connection was in flight")
+		}
+
+		done()
+		if n := table.size(); n != 0 {
+			t.Error("the entry was not removed after the connection completed")
+		}
+	})
+}
+
+func TestPeakEWMA(t *testing.T) {
+	t.Run("the address with the lowest latency is preferred", func(t *testing.T) {
+		b := &PeakEWMA{}
+		addrs := []string{"localhost:4000", "localhost:4001", "localhost:4002"}
+		picker := b.NewPicker("my-service", addrs, nil)
+
+		b.Observe("localhost:4000", 100*time.Millisecond, nil)
+		b.Observe("localhost:4001", 50*time.Millisecond, nil)
+		b.Observe("localhost:4002", 1*time.Millisecond, nil)
+
+		counts := make(map[string]int)
+		for i := 0; i != 3000; i++ {
+			counts[picker.Pick(context.Background())]++
+		}
+
+		if n := counts["localhost:4002"]; n < 1800 {
+			t.Errorf("the fastest address was picked %d times out of 3000", n)
+		}
+		if n := counts["localhost:4000"]; n != 0 {
+			t.Errorf("the slowest address was picked %d times out of 3000", n)
+		}
+	})
+
+	t.Run("latency peaks are recorded immediately", func(t *testing.T) {
+		b := &PeakEWMA{}
+		e := b.stats("localhost:4000")
+		b.Observe("localhost:4000", 1*time.Millisecond, nil)
+		b.Observe("localhost:4000", 100*time.Millisecond, nil)
+
+		if latency, _ := e.latency(b.decay(), time.Now()); latency < float64(90*time.Millisecond) {
+			t.Errorf("bad latency after a latency peak: %s", time.Duration(latency))
+		}
+	})
+
+	t.Run("lower latencies are blended in the moving average", func(t *testing.T) {
+		b := &PeakEWMA{Decay: 10 * time.Millisecond}
+		e := b.stats("localhost:4000")
+		now := time.Now()
+
+		e.observe(float64(100*time.Millisecond), b.decay(), now)
+		e.observe(float64(0), b.decay(), now.Add(10*time.Millisecond))
+
+		// After one decay period, the previous value weights 1/e.
+		if latency, _ := e.latency(b.decay(), now.Add(10*time.Millisecond)); math.Abs(latency-float64(100*time.Millisecond)/math.E) > 1 {
+			t.Errorf("bad latency after one decay period: %s", time.Duration(latency))
+		}
+	})
+
+	t.Run("errors are penalized", func(t *testing.T) {
+		b := &PeakEWMA{Penalty: time.Second}
+		e := b.stats("localhost:4000")
+		b.Observe("localhost:4000", time.Millisecond, errors.New("failed"))
+
+		if latency, _ := e.latency(b.decay(), time.Now()); latency < float64(900*time.Millisecond) {
+			t.Errorf("bad latency after an error: %s", time.Duration(latency))
+		}
+	})
+
+	t.Run("addresses which were never observed receive traffic", func(t *testing.T) {
+		b := &PeakEWMA{}
+		addrs := testAddrs(10)
+		picker := b.NewPicker("my-service", addrs, nil)
+
+		for _, addr := range addrs[:9] {
+			b.Observe(addr, 20*time.Millisecond, nil)
+		}
+
+		// The new address has the mean latency of the others, it is picked
+		// about a tenth of the time.
+		n := 0
+		for i := 0; i != 10000; i++ {
+			if picker.Pick(context.Background()) == addrs[9] {
+				n++
+			}
+		}
+
+		if n < 500 || n > 2000 {
+			t.Errorf("the address which was never observed was picked %d times out of 10000", n)
+		}
+	})
+
+	t.Run("connections in flight increase the cost", func(t *testing.T) {
+		b := &PeakEWMA{}
+		p := b.NewPicker("my-service", []string{"localhost:4000"}, nil).(*peakEWMAPicker)
+		e := p.stats[0]
+		b.Observe("localhost:4000", 10*time.Millisecond, nil)
+		now := time.Now()
+
+		c1 := p.cost(e, b.decay(), now)
+		done := b.Track("localhost:4000")
+		c2 := p.cost(e, b.decay(), now)
+		done()
+
+		if c2 != 2*c1 {
+			t.Errorf("bad cost with a connection in flight: %s != 2 x %s", time.Duration(c2), time.Duration(c1))
+		}
+	})
+
+	t.Run("dial timings are recorded by the dialer", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+
+		b := &PeakEWMA{}
+		cache := &Cache{
+			Registry: registry{"my-service": {l.Addr().String()}},
+			Balancer: b,
+		}
+		defer cache.Close()
+
+		c, err := (&Dialer{Resolver: cache}).Dial("tcp", "my-service:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := b.stats(l.Addr().String())
+		e.mutex.Lock()
+		value := e.value
+		e.mutex.Unlock()
+
+		if value == 0 {
+			t.Error("the dial latency was not recorded")
+		}
+
+		if pending := atomic.LoadInt64(&e.pending); pending != 1 {
+			t.Errorf("bad number of connections in flight: %d", pending)
+		}
+
+		c.Close()
+
+		if pending := atomic.LoadInt64(&e.pending); pending != 0 {
+			t.Errorf("bad number of connections in flight after closing: %d", pending)
+		}
+	})
+}
+
+func TestLeastLoadedDialer(t *testing.T) {
+	var addrs []string
+
+	for i := 0; i != 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		addrs = append(addrs, l.Addr().String())
+	}
+
+	b := &LeastLoaded{}
+	cache := &Cache{
+		Registry: registry{"my-service": addrs},
+		Balancer: b,
+	}
+	defer cache.Close()
+
+	d := &Dialer{Resolver: cache}
+
+	c1, err := d.Dial("tcp", "my-service:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With only two addresses, both are always candidates so the second
+	// connection must go to the address without connections.
+	c2, err := d.Dial("tcp", "my-service:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a1, a2 := c1.RemoteAddr().String(), c2.RemoteAddr().String(); a1 == a2 {
+		t.Error("both connections were made to the same address:", a1)
+	}
+
+	for _, addr := range addrs {
+		if load := b.loads.pending(addr); load != 1 {
+			t.Errorf("%s has a load of %d with one open connection", addr, load)
+		}
+	}
+
+	c1.Close()
+	c2.Close()
+
+	for _, addr := range addrs {
+		if load := b.loads.pending(addr); load != 0 {
+			t.Errorf("%s has a load of %d after connections were closed", addr, load)
+		}
+	}
+}
+
+func TestCacheBalancerState(t *testing.T) {
+	services := map[string][]string{
+		"my-service": {"localhost:4000", "localhost:4001"},
+	}
+
+	mutex := sync.Mutex{}
+	newPickers := 0
+	prevPickers := []Picker{}
+
+	cache := &Cache{
+		Registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return copyStrings(services[name]), 10 * time.Millisecond, nil
+		}),
+		Balancer: balancerFunc(func(name string, addrs []string, prev Picker) Picker {
+			mutex.Lock()
+			defer mutex.Unlock()
+			newPickers++
+			prevPickers = append(prevPickers, prev)
+			return RoundRobin{}.NewPicker(name, addrs, prev)
+		}),
+		RefreshAhead: 10 * time.Millisecond,
+	}
+	defer cache.Close()
+
+	waitRefreshes := func(n int64) {
+		for deadline := time.Now().Add(time.Second); cache.Stats().Refreshes < n; {
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for the cache entry to be refreshed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	first, _ := cache.Resolve(context.Background(), "my-service")
+	waitRefreshes(1)
+	second, _ := cache.Resolve(context.Background(), "my-service")
+
+	if first == second {
+		t.Errorf("the round robin position was not retained after a refresh: %s", first)
+	}
+
+	mutex.Lock()
+	if newPickers != 1 {
+		t.Errorf("pickers were created when the addresses did not change: %d", newPickers)
+	}
+	services["my-service"] = []string{"localhost:4002"}
+	mutex.Unlock()
+
+	// Wait for the entry to expire so the next call sees the new addresses.
+	time.Sleep(20 * time.Millisecond)
+
+	if addr, _ := cache.Resolve(context.Background(), "my-service"); addr != "localhost:4002" {
+		t.Error("bad address after the addresses changed:", addr)
+	}
+
+	mutex.Lock()
+	if newPickers != 2 || prevPickers[1] == nil {
+		t.Errorf("the previous picker was not passed when the addresses changed: %d %v", newPickers, prevPickers)
+	}
+	mutex.Unlock()
+}
+
+func TestRegistryResolverEmpty(t *testing.T) {
+	r := &RegistryResolver{Registry: registry{"my-service": nil}}
+
+	_, err := r.Resolve(context.Background(), "my-service")
+	if !isUnreachable(err) {
+		t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+	}
+
+	if !strings.Contains(err.Error(), "my-service") {
+		t.Error("the error does not mention the service name:", err)
+	}
+}
+
+func (t *addrTable) pending(addr string) int64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if e := t.entries[addr]; e != nil {
+		return atomic.LoadInt64(&e.pending)
+	}
+	return 0
+}
+
+// stats returns the entry of addr, which is referenced until the end of the
+// test.
+func (b *PeakEWMA) stats(addr string) *addrEntry {
+	return b.addrs.acquire([]string{addr})[0]
+}
+
+func (t *addrTable) size() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return len(t.entries)
+}
+
+type balancerFunc func(string, []string, Picker) Picker
+
+func (f balancerFunc) NewPicker(name string, addrs []string, prev Picker) Picker {
+	return f(name, addrs, prev)
+}
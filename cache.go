@@ -5,6 +5,7 @@ import (
 	"context"
 	"math"
 	"math/rand"
+	"runtime"
 	"sort"
 	"strings"
 	"sync"
@@ -17,7 +18,9 @@ import (
 // registry.
 //
 // When used as a resolver, the cache uses a load balancing strategy to return a
-// different address on every call to Resolve.
+// different address on every call to Resolve. The state of the load balancing
+// strategy is kept across refreshes of cache entries, as long as the addresses
+// of the service do not change.
 //
 // Cache implements both the Registry and Resolver interfaces, which means they
 // are safe to use concurrently from multiple goroutines.
@@ -27,17 +30,144 @@ type Cache struct {
 	// Base registry to cache services for. This field must not be nil.
 	Registry Registry
 
+	// The load balancing strategy used by Resolve to pick addresses. Defaults
+	// to RoundRobin.
+	Balancer Balancer
+
+	// Duration of the slow start window of addresses which appear in the
+	// results of the base registry when an entry is refreshed. During the
+	// window, the share of calls to Resolve returning the address increases
+	// linearly, giving new instances time to warm up. Addresses returned by
+	// the first lookup of a service are not slowed down.
+	//
+	// SlowStartPolicy is called, if not nil, with the service name and
+	// returns the duration of the window for this service, overriding
+	// SlowStart. Zero disables slow start.
+	SlowStart       time.Duration
+	SlowStartPolicy func(name string) time.Duration
+
 	// Minimum and maximum TTLs applied to cache entries.
 	MinTTL time.Duration
 	MaxTTL time.Duration
 
+	// TTLs of negative cache entries, overriding the TTL returned by the base
+	// registry when it returned no addresses (EmptyTTL), an unreachable error
+	// (UnreachableTTL), or any other error (ErrorTTL). Zero means to use the
+	// TTL returned by the base registry, bounded by MinTTL and MaxTTL.
+	EmptyTTL       time.Duration
+	UnreachableTTL time.Duration
+	ErrorTTL       time.Duration
+
+	// TTLPolicy is called, if not nil, with the service name, tags and TTL of
+	// successful lookups on the base registry. It returns the TTL of the cache
+	// entry, which is not bounded by MinTTL and MaxTTL, and whether the result
+	// should be cached at all. This can be used to apply tighter freshness
+	// requirements to some services than others.
+	TTLPolicy func(name string, tags []string, ttl time.Duration) (time.Duration, bool)
+
+	// Fraction of the TTL, between 0 and 1, randomly removed from cache
+	// entries to avoid synchronized expiration of entries created at the same
+	// time, including those of the TTL policy.
+	Jitter float64
+
 	// Maximum size of the cache (in bytes). Defaults to 1 MB.
 	MaxBytes int64
 
-	// concurrent LRU cache
-	mutex sync.Mutex
-	items map[cacheKey]*list.Element
-	queue list.List
+	// Number of shards that the cache is split into, each shard having its own
+	// lock to reduce contention when the cache is used from many goroutines.
+	// The size limits apply to the whole cache, entries are evicted from the
+	// least recently used ones of the shard receiving a new entry first, then
+	// from those of the following shards. Entries are only moved to the front
+	// of their shard once every 100ms, lookups of entries used more often only
+	// take a read lock.
+	//
+	// The value is rounded up to a power of two, and defaults to four times
+	// GOMAXPROCS.
+	Shards int
+
+	// Maximum number of entries in the cache, zero means no limit. Like the
+	// size limit, it applies to the whole cache.
+	MaxEntries int
+
+	// When FrequencyAdmission is true, the cache tracks how often names are
+	// looked up (using a TinyLFU-style frequency sketch), and new entries only
+	// replace the least recently used ones when they are looked up more often.
+	// This prevents bursts of names looked up only once from evicting entries
+	// that are used frequently.
+	FrequencyAdmission bool
+
+	// Maximum amount of time that entries are served after they expired, while
+	// a single lookup refreshes them in the background. Zero disables serving
+	// stale entries, callers wait for the base registry instead.
+	MaxStale time.Duration
+
+	// Time before the expiration of entries at which they start being
+	// refreshed in the background. Zero disables refreshing ahead of the
+	// expiration.
+	RefreshAhead time.Duration
+
+	// Maximum amount of time that entries are served after they expired when
+	// the base registry fails to refresh them. Failed refreshes are retried
+	// with an exponential backoff, starting at RetryBackoff (1 second by
+	// default) and growing up to MaxRetryBackoff (1 minute by default).
+	MaxStaleOnError time.Duration
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// Timeout of lookups on the base registry. Defaults to 10 seconds.
+	LookupTimeout time.Duration
+
+	// Maximum number of concurrent lookups on the base registry, zero means no
+	// limit.
+	MaxConcurrentLookups int
+
+	// Path of a file where snapshots of the cache are periodically written,
+	// and loaded from when the cache is first used. Entries loaded from the
+	// snapshot are served until they are refreshed from the base registry.
+	// Snapshots are also written when the cache is closed.
+	SnapshotPath string
+
+	// Maximum amount of time that entries loaded from a snapshot are served
+	// after they expired, when the base registry fails to refresh them. It
+	// only extends MaxStaleOnError. Defaults to 1 hour.
+	MaxSnapshotStale time.Duration
+
+	// Interval at which snapshots are written. Defaults to 1 minute.
+	SnapshotInterval time.Duration
+
+	// Number of consecutive failures to connect to an address, as observed
+	// by a Dialer using the cache, after which the address is ejected from the
+	// rotation of Resolve. Zero disables outlier detection.
+	//
+	// Addresses are ejected for EjectionTime (30 seconds by default), doubled
+	// each time they are ejected again without having accepted a connection
+	// in between, up to MaxEjectionTime (5 minutes by default). No more than
+	// MaxEjectionPercent of the addresses of a service (50% by default) are
+	// ejected at the same time.
+	EjectionFailures   int
+	EjectionTime       time.Duration
+	MaxEjectionTime    time.Duration
+	MaxEjectionPercent int
+
+	// background work, canceled when the cache is closed
+	once      sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+	slots     chan struct{}
+	join      sync.WaitGroup
+	joinMutex sync.RWMutex
+	closed    bool
+
+	// concurrent LRU cache, split into shards
+	shards []cacheShard
+
+	// functions called when the addresses of entries change
+	subMutex    sync.Mutex
+	subscribers []*cacheSubscriber
+
+	// addresses ejected by outlier detection, by service name
+	// (map[string]*cacheOutliers)
+	outliers sync.Map
 
 	// stats
 	bytes     int64
@@ -45,6 +175,15 @@ type Cache struct {
 	hits      int64
 	misses    int64
 	evictions int64
+	capacity  int64
+	expiry    int64
+	rejects   int64
+	refreshes int64
+	staleHits int64
+	errors    int64
+	ejections int64
+	ejected   int64
+	snapshots int64
 }
 
 // CacheStats exposes internal statistics on service cache utilization.
@@ -54,6 +193,27 @@ type CacheStats struct {
 	Hits      int64 `metric:"services.cache.hits"      type:"counter"`
 	Misses    int64 `metric:"services.cache.misses"    type:"counter"`
 	Evictions int64 `metric:"services.cache.evictions" type:"counter"`
+	Refreshes int64 `metric:"services.cache.refreshes" type:"counter"`
+	StaleHits int64 `metric:"services.cache.stale"     type:"counter"`
+	Errors    int64 `metric:"services.cache.errors"    type:"counter"`
+
+	// Break down of evictions by reason, entries evicted to make room for new
+	// ones (capacity), or because they expired (expiry). Rejections count the
+	// new entries which were evicted right away by the admission policy, they
+	// are also counted as capacity evictions. Evictions also include entries
+	// removed by calls to Invalidate or Purge.
+	CapacityEvictions int64 `metric:"services.cache.evictions.capacity" type:"counter"`
+	ExpiryEvictions   int64 `metric:"services.cache.evictions.expiry"   type:"counter"`
+	Rejections        int64 `metric:"services.cache.rejections"         type:"counter"`
+
+	// Number of times addresses were ejected by outlier detection, and number
+	// of addresses currently ejected.
+	Ejections int64 `metric:"services.cache.ejections" type:"counter"`
+	Ejected   int64 `metric:"services.cache.ejected"   type:"gauge"`
+
+	// Number of snapshots that failed to be loaded from or written to the
+	// snapshot path.
+	SnapshotErrors int64 `metric:"services.cache.snapshot.errors" type:"counter"`
 }
 
 // Stats takes a snapshot of the current utilization statistics of the cache.
@@ -68,135 +228,782 @@ func (c *Cache) Stats() CacheStats {
 		Hits:      atomic.LoadInt64(&c.hits),
 		Misses:    atomic.LoadInt64(&c.misses),
 		Evictions: atomic.LoadInt64(&c.evictions),
+		Refreshes: atomic.LoadInt64(&c.refreshes),
+		StaleHits: atomic.LoadInt64(&c.staleHits),
+		Errors:    atomic.LoadInt64(&c.errors),
+
+		CapacityEvictions: atomic.LoadInt64(&c.capacity),
+		ExpiryEvictions:   atomic.LoadInt64(&c.expiry),
+		Rejections:        atomic.LoadInt64(&c.rejects),
+
+		Ejections: atomic.LoadInt64(&c.ejections),
+		Ejected:   atomic.LoadInt64(&c.ejected),
+
+		SnapshotErrors: atomic.LoadInt64(&c.snapshots),
+	}
+}
+
+// Close cancels lookups in flight on the base registry and waits for background
+// work of the cache to complete. Entries that are looked up after the cache was
+// closed fail with a cancellation error.
+func (c *Cache) Close() error {
+	c.init()
+
+	c.joinMutex.Lock()
+	c.closed = true
+	c.joinMutex.Unlock()
+
+	c.cancel()
+	c.join.Wait()
+	return nil
+}
+
+// spawn runs f in a goroutine that Close waits for. Once the cache is closed,
+// f is called synchronously instead, lookups on the base registry fail right
+// away at this point.
+func (c *Cache) spawn(f func()) {
+	c.joinMutex.RLock()
+	defer c.joinMutex.RUnlock()
+
+	if c.closed {
+		f()
+		return
+	}
+
+	c.join.Add(1)
+	go func() {
+		defer c.join.Done()
+		f()
+	}()
+}
+
+func (c *Cache) init() {
+	c.once.Do(func() {
+		c.shards = make([]cacheShard, c.shardCount())
+		for i := range c.shards {
+			c.shards[i].items = make(map[cacheKey]*list.Element)
+			if c.FrequencyAdmission {
+				c.shards[i].sketch = newCacheSketch(c.sketchWidth())
+			}
+		}
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+		if n := c.MaxConcurrentLookups; n > 0 {
+			c.slots = make(chan struct{}, n)
+		}
+		if path := c.SnapshotPath; path != "" {
+			c.loadSnapshot(path)
+			c.join.Add(1)
+			go c.writeSnapshots(path)
+		}
+	})
+}
+
+// CacheQuery represents a service name and list of tags to preload in a cache.
+type CacheQuery struct {
+	Name string
+	Tags []string
+}
+
+// Preload looks up the given list of queries, populating the cache with their
+// results. The method blocks until all lookups completed or the context was
+// canceled, and returns the first error that occurred.
+//
+// Preload is intended to be used to warm up the cache of a service before it
+// starts accepting traffic.
+func (c *Cache) Preload(ctx context.Context, queries ...CacheQuery) error {
+	errs := make([]error, len(queries))
+	wg := sync.WaitGroup{}
+
+	for i, q := range queries {
+		wg.Add(1)
+		go func(err *error, q CacheQuery) {
+			defer wg.Done()
+			_, *err = c.lookup(ctx, q.Name, q.Tags...)
+		}(&errs[i], q)
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Invalidate removes all entries for the given service name from the cache,
+// regardless of the tags they were looked up with.
+//
+// Entries which are still waiting for their first lookup to complete are not
+// removed since their results are already being fetched from the base
+// registry.
+func (c *Cache) Invalidate(name string) {
+	c.removeIf(func(key cacheKey) bool { return key.name == name })
+}
+
+// InvalidateTags removes the entry for the given service name and tags from
+// the cache.
+func (c *Cache) InvalidateTags(name string, tags ...string) {
+	key := makeCacheKey(name, sortedStrings(tags))
+	c.removeIf(func(k cacheKey) bool { return k == key })
+}
+
+// Purge removes all entries from the cache.
+func (c *Cache) Purge() {
+	c.removeIf(func(cacheKey) bool { return true })
+}
+
+func (c *Cache) removeIf(match func(cacheKey) bool) {
+	c.init()
+
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mutex.Lock()
+		for key, elem := range shard.items {
+			if item := elem.Value.(*cacheItem); match(key) && item.isReady() {
+				c.evict(shard, elem, nil)
+			}
+		}
+		shard.mutex.Unlock()
+	}
+}
+
+// CacheUpdate carries the details of a change in the set of addresses of a
+// cache entry.
+type CacheUpdate struct {
+	Name string
+	Tags []string
+
+	// Addresses that were added to and removed from the entry.
+	Added   []string
+	Removed []string
+}
+
+// Subscribe registers f to be called when refreshing a cache entry changes its
+// set of addresses, for example to close connections to instances of a service
+// that went away, or establish connections to new ones. All the addresses of
+// an entry are reported as removed when the base registry reports the service
+// as unreachable.
+//
+// The function is called from the goroutine which refreshed the entry, it must
+// not block and must be safe to use concurrently from multiple goroutines.
+//
+// The returned function unsubscribes f from the cache.
+func (c *Cache) Subscribe(f func(CacheUpdate)) (unsubscribe func()) {
+	sub := &cacheSubscriber{notify: f}
+
+	c.subMutex.Lock()
+	c.subscribers = append(c.subscribers, sub)
+	c.subMutex.Unlock()
+
+	return func() {
+		c.subMutex.Lock()
+		defer c.subMutex.Unlock()
+
+		for i, s := range c.subscribers {
+			if s == sub {
+				c.subscribers = append(c.subscribers[:i:i], c.subscribers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// notify calls the subscribers of the cache if the addresses of next differ
+// from those of prev. When the service became unreachable, all the addresses
+// of prev are reported as removed, other failed lookups are ignored.
+func (c *Cache) notify(prev, next *cacheItem) {
+	if prev.err != nil || (next.err != nil && !isUnreachable(next.err)) {
+		return
+	}
+
+	addrs := next.addrs
+	if next.err != nil {
+		addrs = nil
+	}
+
+	c.subMutex.Lock()
+	subscribers := c.subscribers
+	c.subMutex.Unlock()
+
+	if len(subscribers) == 0 {
+		return
+	}
+
+	update := CacheUpdate{
+		Name:    next.key.name,
+		Tags:    copyStrings(next.tags),
+		Added:   diffStrings(addrs, prev.addrs),
+		Removed: diffStrings(prev.addrs, addrs),
+	}
+
+	if len(update.Added) == 0 && len(update.Removed) == 0 {
+		return
+	}
+
+	for _, sub := range subscribers {
+		sub.notify(update)
 	}
 }
 
+type cacheSubscriber struct {
+	notify func(CacheUpdate)
+}
+
 // Resolve satisfies the Resolver interface.
 func (c *Cache) Resolve(ctx context.Context, name string) (string, error) {
-	index, addrs, _, err := c.lookup(ctx, name)
+	item, err := c.lookup(ctx, name)
 	if err != nil {
 		return "", err
 	}
 
-	i := atomic.AddUint64(index, +1)
-	n := uint64(len(addrs))
-
-	if n == 0 {
+	if item.picker == nil {
 		return "", &cacheError{name: name}
 	}
 
-	return addrs[i%n], nil
+	picker := c.picker(item)
+	addr := picker.Pick(ctx)
+
+	if item.warming != nil {
+		addr = c.warm(ctx, item, picker, addr)
+	}
+
+	return addr, nil
 }
 
-// Lookup satisfies the Registry interface.
-func (c *Cache) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
-	_, addrs, deadline, err := c.lookup(ctx, name, tags...)
+// ObserveDial satisfies the DialObserver interface, it is used for outlier
+// detection and forwards the call to the balancer if it implements the
+// interface.
+func (c *Cache) ObserveDial(name string, addr string, rtt time.Duration, err error) func() {
+	if c.EjectionFailures > 0 {
+		c.observeOutlier(name, addr, err)
+	}
+	return observeDial(c.Balancer, name, addr, rtt, err)
+}
+
+// LookupEndpoints satisfies the EndpointRegistry interface.
+//
+// The weights of the endpoints are those exposed by the base registry, or 1 if
+// it does not implement EndpointRegistry.
+func (c *Cache) LookupEndpoints(ctx context.Context, name string, tags ...string) ([]Endpoint, time.Duration, error) {
+	item, err := c.lookup(ctx, name, tags...)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	now := time.Now()
-	ttl := time.Duration(0)
+	weights := weightsOf(item.addrs, item.weights)
+	endpoints := make([]Endpoint, len(item.addrs))
 
-	if !now.After(deadline) {
-		ttl = deadline.Sub(now)
+	for i, addr := range item.addrs {
+		endpoints[i] = Endpoint{Addr: addr, Weight: 1}
+		if weights != nil {
+			endpoints[i].Weight = weights[i]
+		}
 	}
 
-	return copyStrings(addrs), ttl, err
+	return endpoints, item.remaining(), nil
 }
 
-func (c *Cache) lookup(ctx context.Context, name string, tags ...string) (*uint64, []string, time.Time, error) {
+// Lookup satisfies the Registry interface.
+func (c *Cache) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+	item, err := c.lookup(ctx, name, tags...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return copyStrings(item.addrs), item.remaining(), nil
+}
+
+func (c *Cache) lookup(ctx context.Context, name string, tags ...string) (*cacheItem, error) {
 	if err := ctx.Err(); err != nil {
-		return nil, nil, time.Time{}, err
+		return nil, err
+	}
+
+	c.init()
+
+	if err := c.ctx.Err(); err != nil {
+		return nil, err
 	}
 
 	tags = sortedStrings(tags)
 	key := makeCacheKey(name, tags)
+	hash := key.hash()
+	shard := c.shard(hash)
+
+	// When an entry expired, it is kept to compare its addresses with those of
+	// the entry replacing it.
+	var expired *cacheItem
 
 	for {
-		c.mutex.Lock()
-		elem, hit := c.items[key]
-		if hit {
-			c.queue.MoveToFront(elem)
-		} else {
-			elem = c.queue.PushFront(newCacheItem(key, tags))
-			if c.items == nil {
-				c.items = map[cacheKey]*list.Element{key: elem}
-			} else {
-				c.items[key] = elem
-			}
-		}
-		c.mutex.Unlock()
+		elem, item, hit := c.get(shard, key, hash, tags)
 
-		item := elem.Value.(*cacheItem)
 		if !hit {
-			go item.lookup(c.Registry, c.minTTL(), c.maxTTL())
+			atomic.AddInt64(&c.size, +1)
+			atomic.AddInt64(&c.misses, +1)
+			prev := expired
+			c.spawn(func() { c.fill(shard, elem, item, prev) })
+		} else if expired != nil {
+			// Another goroutine replaced the expired entry already.
+			c.release(expired, nil)
+			expired = nil
 		}
 
 		select {
 		case <-item.ready:
 		case <-ctx.Done():
-			return nil, nil, time.Time{}, ctx.Err()
+			return nil, ctx.Err()
 		}
 
-		if time.Now().After(item.ttl) {
-			evict := false
-			c.mutex.Lock()
-			// Make sure another goroutine did not concurrently remove the
-			// item.
-			if evict = c.items[key] == elem; evict {
-				c.queue.Remove(elem)
-				delete(c.items, key)
+		now := time.Now()
+
+		switch {
+		case item.restored && now.Before(item.ttl.Add(c.maxStaleOnError(item))):
+			atomic.AddInt64(&c.staleHits, +1)
+			c.refresh(shard, elem, item)
+
+		case !now.After(item.ttl.Add(-c.RefreshAhead)):
+		case !now.After(item.ttl):
+			c.refresh(shard, elem, item)
+
+		case hit && item.err == nil && now.Before(item.ttl.Add(c.MaxStale)):
+			atomic.AddInt64(&c.staleHits, +1)
+			c.refresh(shard, elem, item)
+
+		case hit && item.err == nil && now.Before(item.ttl.Add(c.maxStaleOnError(item))):
+			// Wait for the entry to be refreshed, if the base registry fails
+			// or the context ends first the item is served until the next
+			// retry. Retries are made in the background, the registry already
+			// failed and callers should not wait for it again. The refreshed
+			// item is used even if it already expired (when the TTL is zero
+			// for example), looking it up again would refresh it over and
+			// over.
+			shard.mutex.Lock()
+			retry := item.failures != 0
+			shard.mutex.Unlock()
+
+			if next := c.refresh(shard, elem, item); next != nil && !retry {
+				select {
+				case <-next.ready:
+				case <-ctx.Done():
+				}
+				if next.isReady() && next.err == nil {
+					item = next
+					break
+				}
 			}
-			c.mutex.Unlock()
+			atomic.AddInt64(&c.staleHits, +1)
 
-			if evict {
-				atomic.AddInt64(&c.bytes, -item.bytes)
-				atomic.AddInt64(&c.size, -1)
-				atomic.AddInt64(&c.evictions, +1)
+		default:
+			if c.remove(shard, elem, item) {
 				if hit {
 					// In case we had a cache miss, still let the code go
-					// through otherwise we may enture en infinite loop when the
-					// TTL is so low. Basically, this ensures that new items are
-					// always used at least once.
+					// through otherwise we may enture en infinite loop when
+					// the TTL is so low. Basically, this ensures that new
+					// items are always used at least once.
+					expired = item
 					continue
 				}
+				c.release(item, nil)
 			}
 		}
 
 		if hit {
 			atomic.AddInt64(&c.hits, +1)
+		}
+
+		return item, item.err
+	}
+}
+
+// get returns the element and item of key in shard, inserting a new item if
+// the key was missing.
+//
+// Entries are moved to the front of the queue at most once per
+// cachePromoteInterval, hits on entries which were promoted recently only take
+// a read lock on the shard, so services resolving the same names over and over
+// do not contend on the shard mutex.
+func (c *Cache) get(shard *cacheShard, key cacheKey, hash uint64, tags []string) (elem *list.Element, item *cacheItem, hit bool) {
+	if shard.sketch != nil {
+		shard.sketch.increment(hash)
+	}
+
+	now := time.Now().UnixNano()
+
+	// The value of the list element may be swapped by a background refresh, it
+	// must be loaded while holding the lock.
+	shard.mutex.RLock()
+	if elem, hit = shard.items[key]; hit {
+		item = elem.Value.(*cacheItem)
+	}
+	shard.mutex.RUnlock()
+
+	if hit && now-atomic.LoadInt64(&item.promoted) < int64(cachePromoteInterval) {
+		return elem, item, hit
+	}
+
+	shard.mutex.Lock()
+	if elem, hit = shard.items[key]; hit {
+		shard.queue.MoveToFront(elem)
+	} else {
+		elem = shard.queue.PushFront(newCacheItem(key, hash, tags))
+		shard.items[key] = elem
+	}
+	item = elem.Value.(*cacheItem)
+	atomic.StoreInt64(&item.promoted, now)
+	shard.mutex.Unlock()
+	return elem, item, hit
+}
+
+// cachePromoteInterval is the minimum amount of time between two moves of an
+// entry to the front of the queue of its shard.
+const cachePromoteInterval = 100 * time.Millisecond
+
+// grow adds bytes to the size of shard, then evicts the least recently used
+// entries of the shard until the cache fits in the maximum number of bytes and
+// entries. The shard mutex must be held.
+//
+// The last entry of the shard is never evicted, shrink must be called after
+// releasing the mutex to evict entries of other shards if the cache still does
+// not fit.
+//
+// When candidate is not nil, it is the element of an entry that was just added
+// to the shard, the admission policy may decide to evict it instead of the
+// least recently used entries.
+func (c *Cache) grow(shard *cacheShard, candidate *list.Element, bytes int64) {
+	shard.bytes += bytes
+	atomic.AddInt64(&c.bytes, bytes)
+
+	for c.overflow() && shard.queue.Len() > 1 {
+		victim := shard.queue.Back()
+		if victim == candidate {
+			victim = victim.Prev()
+		}
+
+		if candidate != nil && !c.admit(shard, candidate, victim) {
+			victim, candidate = candidate, nil
+		}
+
+		c.evict(shard, victim, &c.capacity)
+	}
+}
+
+// shrink evicts the least recently used entries of the shards following the
+// one that keys with the given hash belong to, until the cache fits in the
+// maximum number of bytes and entries. The shard of the hash comes last, its
+// remaining entries are only evicted if they do not fit in the cache on their
+// own. No shard mutex must be held.
+//
+// When candidate is not nil, it is the element of an entry that was just added
+// to the shard of the hash, the admission policy may decide to evict it instead
+// of the entries of other shards.
+func (c *Cache) shrink(hash uint64, candidate *list.Element) {
+	if !c.overflow() {
+		return
+	}
+
+	own := c.shard(hash)
+	candidateFreq := uint8(0)
+
+	if candidate != nil && own.sketch != nil {
+		own.mutex.Lock()
+		if item := candidate.Value.(*cacheItem); own.items[item.key] == candidate {
+			candidateFreq = own.sketch.estimate(hash)
 		} else {
-			atomic.AddInt64(&c.size, +1)
-			atomic.AddInt64(&c.misses, +1)
+			candidate = nil // already evicted by the admission policy
+		}
+		own.mutex.Unlock()
+	} else {
+		candidate = nil
+	}
 
-			bytes := atomic.AddInt64(&c.bytes, +item.bytes)
-			maxBytes := int64(c.maxBytes())
+	for i := 1; i < len(c.shards) && c.overflow(); i++ {
+		shard := c.shard(hash + uint64(i))
+		shard.mutex.Lock()
 
-			for bytes > maxBytes {
-				c.mutex.Lock()
+		for c.overflow() {
+			victim := shard.queue.Back()
+			if victim == nil {
+				break
+			}
 
-				if len(c.items) == 0 {
-					c.mutex.Unlock()
-					break
+			if candidate != nil && candidateFreq <= shard.sketch.estimate(victim.Value.(*cacheItem).hash) {
+				shard.mutex.Unlock()
+				atomic.AddInt64(&c.rejects, +1)
+
+				own.mutex.Lock()
+				if item := candidate.Value.(*cacheItem); own.items[item.key] == candidate {
+					c.evict(own, candidate, &c.capacity)
 				}
+				own.mutex.Unlock()
+				return
+			}
 
-				oldestElem := c.queue.Back()
-				oldestItem := oldestElem.Value.(*cacheItem)
-				c.queue.Remove(oldestElem)
-				delete(c.items, oldestItem.key)
-				c.mutex.Unlock()
+			c.evict(shard, victim, &c.capacity)
+		}
 
-				bytes = atomic.AddInt64(&c.bytes, -oldestItem.bytes)
-				atomic.AddInt64(&c.size, -1)
-				atomic.AddInt64(&c.evictions, +1)
-			}
+		shard.mutex.Unlock()
+	}
+
+	own.mutex.Lock()
+	for c.overflow() {
+		victim := own.queue.Back()
+		if victim == nil {
+			break
+		}
+		c.evict(own, victim, &c.capacity)
+	}
+	own.mutex.Unlock()
+}
+
+// overflow returns true if the cache exceeds its maximum number of bytes or
+// entries.
+func (c *Cache) overflow() bool {
+	return atomic.LoadInt64(&c.bytes) > c.maxBytes() || atomic.LoadInt64(&c.size) > c.maxEntries()
+}
+
+// admit returns true if the candidate element is looked up more frequently
+// than the victim, or if the admission policy is disabled.
+func (c *Cache) admit(shard *cacheShard, candidate, victim *list.Element) bool {
+	if shard.sketch == nil {
+		return true
+	}
+
+	candidateFreq := shard.sketch.estimate(candidate.Value.(*cacheItem).hash)
+	victimFreq := shard.sketch.estimate(victim.Value.(*cacheItem).hash)
+
+	if candidateFreq <= victimFreq {
+		atomic.AddInt64(&c.rejects, +1)
+		return false
+	}
+
+	return true
+}
+
+// evict removes elem from shard, incrementing the counter of the reason for
+// evicting the entry if it is not nil, and releases the pickers of the entry
+// once it was filled. The shard mutex must be held.
+func (c *Cache) evict(shard *cacheShard, elem *list.Element, reason *int64) {
+	if item := c.unlink(shard, elem, reason); item.filled {
+		c.release(item, nil)
+	}
+}
+
+// unlink removes elem from shard like evict, without releasing the pickers of
+// its entry. The shard mutex must be held.
+func (c *Cache) unlink(shard *cacheShard, elem *list.Element, reason *int64) *cacheItem {
+	item := elem.Value.(*cacheItem)
+	shard.queue.Remove(elem)
+	delete(shard.items, item.key)
+	shard.bytes -= item.bytes
+
+	atomic.AddInt64(&c.bytes, -item.bytes)
+	atomic.AddInt64(&c.size, -1)
+	atomic.AddInt64(&c.evictions, +1)
+
+	if reason != nil {
+		atomic.AddInt64(reason, +1)
+	}
+
+	return item
+}
+
+// remove evicts item from the cache, unless another goroutine concurrently
+// removed it or replaced it with a refreshed version. The method returns true
+// if the item was evicted, the caller is then responsible for releasing its
+// pickers, which the entry replacing it may reuse.
+func (c *Cache) remove(shard *cacheShard, elem *list.Element, item *cacheItem) bool {
+	shard.mutex.Lock()
+	evict := shard.items[item.key] == elem && elem.Value == item
+	if evict {
+		c.unlink(shard, elem, &c.expiry)
+	}
+	shard.mutex.Unlock()
+	return evict
+}
+
+// fill looks up the addresses of item in the base registry and marks it ready.
+// The size of the item is accounted for if it was not evicted in the meantime.
+//
+// If prev is not nil, it is the expired item that item replaces, subscribers
+// are notified if their addresses differ and its pickers are released.
+func (c *Cache) fill(shard *cacheShard, elem *list.Element, item *cacheItem, prev *cacheItem) {
+	c.fetch(item)
+	c.pick(item, prev)
+	c.warmup(item, prev)
+
+	shard.mutex.Lock()
+	item.filled = true
+	cached := shard.items[item.key] == elem && elem.Value == item
+	if cached {
+		if item.transient {
+			c.evict(shard, elem, &c.expiry)
+		} else {
+			item.bytes = item.sizeof()
+			c.grow(shard, elem, item.bytes)
 		}
+	}
+	shard.mutex.Unlock()
+
+	c.shrink(item.hash, elem)
+	close(item.ready)
+
+	if cached {
+		c.pruneOutliers(item)
+	} else {
+		// The item was evicted before it was filled.
+		c.release(item, nil)
+	}
+
+	if prev != nil {
+		c.notify(prev, item)
+		c.release(prev, item)
+	}
+}
+
+// fetch looks up the addresses of item in the base registry, waiting for a
+// lookup slot to be available if the number of concurrent lookups is limited.
+func (c *Cache) fetch(item *cacheItem) {
+	ctx, cancel := context.WithTimeout(c.ctx, c.lookupTimeout())
+	defer cancel()
+
+	var addrs []string
+	var weights map[string]int
+	var ttl time.Duration
+	err := ctx.Err()
+
+	if err == nil && c.slots != nil {
+		select {
+		case c.slots <- struct{}{}:
+			defer func() { <-c.slots }()
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	if err == nil {
+		addrs, weights, ttl, err = lookupEndpoints(ctx, c.Registry, item.key.name, item.tags...)
+	}
+
+	ttl, item.transient = c.ttl(item.key.name, item.tags, addrs, ttl, err)
+	item.set(addrs, ttl, err)
+	item.weights = weights
+}
+
+// refresh starts a background lookup to replace item in the cache, unless one
+// is already in flight. The method returns the item being looked up, or nil if
+// item was already replaced or is waiting to retry a failed refresh.
+func (c *Cache) refresh(shard *cacheShard, elem *list.Element, item *cacheItem) *cacheItem {
+	shard.mutex.Lock()
+	next := item.refresh
+	start := next == nil && elem.Value == item && time.Now().After(item.retryAt)
+	if start {
+		next = newCacheItem(item.key, item.hash, item.tags)
+		item.refresh = next
+	}
+	shard.mutex.Unlock()
+
+	if start {
+		c.spawn(func() { c.update(shard, elem, item, next) })
+	}
+
+	return next
+}
+
+// update fills next and swaps it with item in the cache, if item was not
+// evicted in the meantime.
+//
+// When the lookup fails and item still holds addresses that can be served,
+// item is kept in the cache and the refresh is scheduled to be retried.
+func (c *Cache) update(shard *cacheShard, elem *list.Element, item *cacheItem, next *cacheItem) {
+	c.fetch(next)
+	c.pick(next, item)
+	c.warmup(next, item)
+	now := time.Now()
+
+	shard.mutex.Lock()
+	next.filled = true
+	failed := next.err != nil && item.err == nil && now.Before(item.ttl.Add(c.maxStaleOnError(item)))
+	replace := shard.items[item.key] == elem && elem.Value == item && !failed
+	if replace {
+		if next.transient {
+			c.evict(shard, elem, &c.expiry)
+		} else {
+			elem.Value = next
+			next.bytes = next.sizeof()
+			c.grow(shard, nil, next.bytes-item.bytes)
+		}
+	}
+	if failed {
+		item.failures++
+		item.retryAt = now.Add(c.retryBackoff(item.failures))
+	}
+	item.refresh = nil
+	shard.mutex.Unlock()
+
+	c.shrink(item.hash, nil)
+	close(next.ready)
+
+	switch {
+	case replace && !next.transient:
+		c.release(item, next)
+	case !failed:
+		// The item was evicted in the meantime, or next must not be cached,
+		// the pickers of item are released by whoever evicted it.
+		c.release(next, item)
+	}
+
+	if replace {
+		atomic.AddInt64(&c.refreshes, +1)
+		c.notify(item, next)
+		c.pruneOutliers(next)
+	}
+
+	if failed {
+		atomic.AddInt64(&c.errors, +1)
+	}
+}
+
+// release releases the pickers of item which are not reused by next, if next is
+// not nil. Pickers of items which were released are not rebuilt by outlier
+// detection.
+func (c *Cache) release(item *cacheItem, next *cacheItem) {
+	item.healthyMutex.Lock()
+	item.released = true
+	h, _ := item.healthy.Load().(*cacheHealthy)
+	item.healthyMutex.Unlock()
+
+	if h != nil && h.picker != item.picker {
+		releasePicker(h.picker)
+	}
 
-		return &item.index, item.addrs, item.ttl, item.err
+	if next == nil || next.picker != item.picker {
+		releasePicker(item.picker)
 	}
 }
 
+// pick sets the picker that Resolve uses to select addresses of item. If prev
+// is not nil and has the same addresses and weights, its picker is reused so
+// the state of the load balancing strategy is retained.
+func (c *Cache) pick(item *cacheItem, prev *cacheItem) {
+	if item.err != nil || len(item.addrs) == 0 {
+		return
+	}
+
+	var prevPicker Picker
+
+	if prev != nil && prev.picker != nil {
+		if sameAddrs(item.addrs, prev.addrs) && equalWeights(item.weights, prev.weights) {
+			item.picker = prev.picker
+			return
+		}
+		prevPicker = prev.picker
+	}
+
+	item.picker = newPicker(c.Balancer, item.key.name, item.addrs, item.weights, prevPicker)
+}
+
 func (c *Cache) maxBytes() int64 {
 	if bytes := c.MaxBytes; bytes > 0 {
 		return int64(bytes)
@@ -204,6 +1011,120 @@ func (c *Cache) maxBytes() int64 {
 	return 1024 * 1024 // 1 MB
 }
 
+// ttl returns the TTL of a cache entry for the result of a lookup on the base
+// registry, and true if the result must not be cached.
+func (c *Cache) ttl(name string, tags []string, addrs []string, ttl time.Duration, err error) (time.Duration, bool) {
+	transient := false
+
+	switch {
+	case err == nil && len(addrs) != 0 && c.TTLPolicy != nil:
+		var cache bool
+		ttl, cache = c.TTLPolicy(name, tags, ttl)
+		transient = !cache
+	case err == nil && len(addrs) == 0 && c.EmptyTTL > 0:
+		ttl = c.EmptyTTL
+	case err != nil && isUnreachable(err) && c.UnreachableTTL > 0:
+		ttl = c.UnreachableTTL
+	case err != nil && !isUnreachable(err) && c.ErrorTTL > 0:
+		ttl = c.ErrorTTL
+	default:
+		if minTTL := c.minTTL(); ttl < minTTL {
+			ttl = minTTL
+		}
+		if maxTTL := c.maxTTL(); ttl > maxTTL {
+			ttl = maxTTL
+		}
+	}
+
+	if jitter := c.Jitter; jitter > 0 && jitter <= 1 {
+		ttl -= time.Duration(jitter * rand.Float64() * float64(ttl))
+	}
+
+	return ttl, transient
+}
+
+func (c *Cache) shardCount() int {
+	n := c.Shards
+	if n <= 0 {
+		n = 4 * runtime.GOMAXPROCS(0)
+	}
+	shards := 1
+	for shards < n {
+		shards *= 2
+	}
+	return shards
+}
+
+// shard returns the shard that keys with the given hash belong to.
+func (c *Cache) shard(hash uint64) *cacheShard {
+	return &c.shards[hash&uint64(len(c.shards)-1)]
+}
+
+func (c *Cache) maxEntries() int64 {
+	if n := c.MaxEntries; n > 0 {
+		return int64(n)
+	}
+	return math.MaxInt64
+}
+
+// sketchWidth returns the number of counters in each row of the frequency
+// sketches of the cache shards, sized after the number of entries they may
+// hold (estimated from the size limit if the number of entries isn't).
+func (c *Cache) sketchWidth() int {
+	n := c.maxBytes() / 256
+	if c.MaxEntries > 0 {
+		n = int64(c.MaxEntries)
+	}
+	return int(n) / c.shardCount()
+}
+
+// maxStaleOnError returns the maximum amount of time that item is served after
+// it expired when the base registry fails to refresh it.
+func (c *Cache) maxStaleOnError(item *cacheItem) time.Duration {
+	if item.restored {
+		if maxStale := c.maxSnapshotStale(); maxStale > c.MaxStaleOnError {
+			return maxStale
+		}
+	}
+	return c.MaxStaleOnError
+}
+
+func (c *Cache) maxSnapshotStale() time.Duration {
+	if maxStale := c.MaxSnapshotStale; maxStale > 0 {
+		return maxStale
+	}
+	return 1 * time.Hour
+}
+
+func (c *Cache) lookupTimeout() time.Duration {
+	if timeout := c.LookupTimeout; timeout > 0 {
+		return timeout
+	}
+	return 10 * time.Second
+}
+
+func (c *Cache) retryBackoff(failures int) time.Duration {
+	backoff := c.RetryBackoff
+	if backoff <= 0 {
+		backoff = 1 * time.Second
+	}
+
+	maxBackoff := c.MaxRetryBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 1 * time.Minute
+	}
+
+	for i := 1; i < failures && backoff < maxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+
+	return backoff
+}
+
 func (c *Cache) minTTL() time.Duration {
 	if ttl := c.MinTTL; ttl > 0 {
 		return ttl
@@ -218,11 +1139,27 @@ func (c *Cache) maxTTL() time.Duration {
 	return time.Duration(math.MaxInt64)
 }
 
+type cacheShard struct {
+	mutex  sync.RWMutex
+	items  map[cacheKey]*list.Element
+	queue  list.List
+	bytes  int64
+	sketch *cacheSketch
+}
+
 type cacheKey struct {
 	name string
 	tags string
 }
 
+// hash returns the FNV-1a hash of the key.
+func (key cacheKey) hash() uint64 {
+	h := fnv1a(fnvOffset64, key.name)
+	// Separate the name and tags so ("ab", "") and ("a", "b") differ.
+	h = fnv1a(h, "\xff")
+	return fnv1a(h, key.tags)
+}
+
 func makeCacheKey(name string, tags []string) cacheKey {
 	return cacheKey{
 		name: name,
@@ -231,44 +1168,92 @@ func makeCacheKey(name string, tags []string) cacheKey {
 }
 
 type cacheItem struct {
-	index uint64
-	key   cacheKey
-	tags  []string
-	addrs []string
-	bytes int64
-	ttl   time.Time
-	err   error
-	ready chan struct{}
+	key    cacheKey
+	hash   uint64
+	tags   []string
+	addrs  []string
+	picker Picker
+	bytes  int64 // guarded by the shard mutex
+	ttl    time.Time
+	err    error
+	ready  chan struct{}
+
+	// weights of addresses, nil if the base registry does not expose them
+	weights map[string]int
+
+	// time at which addresses in their slow start window appeared, and the
+	// duration of the window
+	warming    map[string]time.Time
+	warmupTime time.Duration
+
+	// true if the item was loaded from a snapshot
+	restored bool
+
+	// true if the item must not be cached
+	transient bool
+
+	// time at which the item was last moved to the front of the queue of its
+	// shard (unix nanoseconds)
+	promoted int64
+
+	// true once the picker of the item was set, evicting the item releases
+	// its pickers only then, guarded by the shard mutex
+	filled bool
+
+	// state of background refreshes, guarded by the shard mutex
+	refresh  *cacheItem
+	failures int
+	retryAt  time.Time
+
+	// picker of the addresses which were not ejected by outlier detection
+	// (*cacheHealthy), rebuilt when the version of the ejections of the
+	// service changes, unless the pickers of the item were released
+	healthy      atomic.Value
+	healthyMutex sync.Mutex
+	released     bool
 }
 
-func newCacheItem(key cacheKey, tags []string) *cacheItem {
+func newCacheItem(key cacheKey, hash uint64, tags []string) *cacheItem {
 	return &cacheItem{
 		key:   key,
+		hash:  hash,
+		tags:  tags,
 		ready: make(chan struct{}),
 	}
 }
 
-func (item *cacheItem) lookup(r Registry, minTTL, maxTTL time.Duration) {
-	addrs, ttl, err := r.Lookup(context.Background(), item.key.name, item.tags...)
-
-	if ttl < minTTL {
-		ttl = minTTL
-	}
-
-	if ttl > maxTTL {
-		ttl = maxTTL
-	}
+func (item *cacheItem) set(addrs []string, ttl time.Duration, err error) {
+	item.addrs = shuffledStrings(addrs)
+	item.ttl = time.Now().Add(ttl)
+	item.err = err
+}
 
-	item.bytes = int64(unsafe.Sizeof(*item)) +
-		sizeofStrings(addrs) +
+func (item *cacheItem) sizeof() int64 {
+	return int64(unsafe.Sizeof(*item)) +
+		sizeofStrings(item.addrs) +
 		sizeofString(item.key.name) +
 		sizeofString(item.key.tags) +
-		sizeofStrings(item.tags)
+		sizeofStrings(item.tags) +
+		sizeofWeights(item.weights) +
+		int64(len(item.warming))*int64(unsafe.Sizeof("")+unsafe.Sizeof(time.Time{}))
+}
 
-	item.addrs = shuffledStrings(addrs)
-	item.ttl = time.Now().Add(ttl)
-	item.err = err
-	close(item.ready)
+// remaining returns the time left until item expires, or zero if it already
+// expired.
+func (item *cacheItem) remaining() time.Duration {
+	if ttl := time.Until(item.ttl); ttl > 0 {
+		return ttl
+	}
+	return 0
+}
+
+func (item *cacheItem) isReady() bool {
+	select {
+	case <-item.ready:
+		return true
+	default:
+		return false
+	}
 }
 
 type cacheError struct {
@@ -316,6 +1301,12 @@ func sizeofStrings(s []string) int64 {
 	return size
 }
 
+// sizeofWeights approximates the size of a map of weights, the keys share
+// their memory with the list of addresses.
+func sizeofWeights(w map[string]int) int64 {
+	return int64(len(w)) * int64(unsafe.Sizeof("")+unsafe.Sizeof(0))
+}
+
 func sizeofString(s string) int64 {
 	return int64(unsafe.Sizeof(s)) + int64(len(s))
 }
@@ -2,6 +2,12 @@ package services
 
 import (
 	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -40,6 +46,30 @@ func TestCache(t *testing.T) {
 				}
 			},
 		},
+
+		{
+			scenario: "entry limit with frequency admission",
+			newCache: func(r Registry) *Cache {
+				return &Cache{
+					Registry:           r,
+					MaxEntries:         2,
+					Shards:             1,
+					FrequencyAdmission: true,
+				}
+			},
+		},
+
+		{
+			scenario: "stale while revalidate",
+			newCache: func(r Registry) *Cache {
+				return &Cache{
+					Registry:     r,
+					MaxTTL:       1 * time.Millisecond,
+					MaxStale:     1 * time.Second,
+					RefreshAhead: 500 * time.Microsecond,
+				}
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -55,6 +85,10 @@ func TestCache(t *testing.T) {
 						if (stats.Evictions + stats.Size) != stats.Misses {
 							t.Error("the number of cache misses does not match the sum of the size and evictions")
 						}
+
+						if (stats.CapacityEvictions + stats.ExpiryEvictions) != stats.Evictions {
+							t.Error("the number of evictions does not match the sum of capacity and expiry evictions")
+						}
 					}
 
 					return cache, close
@@ -64,12 +98,785 @@ func TestCache(t *testing.T) {
 	}
 }
 
+func TestCacheMaxEntries(t *testing.T) {
+	recorder := &lookupRecorder{registry: registry{
+		"service-1": {"localhost:4001"},
+		"service-2": {"localhost:4002"},
+		"service-3": {"localhost:4003"},
+	}}
+
+	cache := &Cache{
+		Registry:   recorder,
+		MaxEntries: 2,
+		Shards:     1,
+	}
+	defer cache.Close()
+
+	ctx := context.Background()
+	cache.Lookup(ctx, "service-1")
+	cache.Lookup(ctx, "service-2")
+	cache.Lookup(ctx, "service-3")
+	cache.Lookup(ctx, "service-1")
+
+	if n := len(recorder.lookups); n != 4 {
+		t.Error("the least recently used entry was not evicted:", n, "lookups")
+	}
+
+	if stats := cache.Stats(); stats.Size != 2 || stats.CapacityEvictions != 2 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
+
+func TestCacheMaxEntriesShards(t *testing.T) {
+	services := make(registry)
+	for i := 0; i != 200; i++ {
+		services["service-"+strconv.Itoa(i)] = []string{"localhost:4000"}
+	}
+
+	recorder := &lookupRecorder{registry: services}
+
+	cache := &Cache{
+		Registry:   recorder,
+		MaxEntries: 100,
+		Shards:     256,
+	}
+	defer cache.Close()
+
+	ctx := context.Background()
+
+	// The entries fit in the cache even if some of them are in the same
+	// shard.
+	for n := 0; n != 2; n++ {
+		for i := 0; i != 50; i++ {
+			cache.Lookup(ctx, "service-"+strconv.Itoa(i))
+		}
+	}
+
+	if n := len(recorder.lookups); n != 50 {
+		t.Error("entries were evicted before the cache was full:", n, "lookups")
+	}
+
+	for i := 50; i != 200; i++ {
+		cache.Lookup(ctx, "service-"+strconv.Itoa(i))
+	}
+
+	if stats := cache.Stats(); stats.Size != 100 || stats.CapacityEvictions != 100 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
+
+func TestCacheMaxBytes(t *testing.T) {
+	t.Run("large entries fit in the cache split in many shards", func(t *testing.T) {
+		cache := &Cache{
+			Registry: registry{"my-service": testAddrs(150)},
+			Shards:   256,
+		}
+		defer cache.Close()
+
+		for i := 0; i != 5; i++ {
+			if _, _, err := cache.Lookup(context.Background(), "my-service"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if stats := cache.Stats(); stats.Misses != 1 || stats.Evictions != 0 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+	})
+
+	t.Run("entries of other shards are evicted to make room", func(t *testing.T) {
+		services := make(registry)
+		for i := 0; i != 100; i++ {
+			services["service-"+strconv.Itoa(i)] = testAddrs(10)
+		}
+
+		cache := &Cache{
+			Registry: services,
+			MaxBytes: 4096,
+		}
+		defer cache.Close()
+
+		for name := range services {
+			if _, _, err := cache.Lookup(context.Background(), name); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if stats := cache.Stats(); stats.Bytes > 4096 || stats.Size == 0 || stats.CapacityEvictions == 0 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+	})
+}
+
+func TestCacheFrequencyAdmission(t *testing.T) {
+	for _, shards := range []int{1, 256} {
+		t.Run(strconv.Itoa(shards)+" shards", func(t *testing.T) {
+			recorder := &lookupRecorder{registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+				return []string{"localhost:4000"}, time.Minute, nil
+			})}
+
+			cache := &Cache{
+				Registry:           recorder,
+				MaxEntries:         2,
+				Shards:             shards,
+				FrequencyAdmission: true,
+			}
+			defer cache.Close()
+
+			ctx := context.Background()
+
+			for i := 0; i != 10; i++ {
+				cache.Lookup(ctx, "hot-1")
+				cache.Lookup(ctx, "hot-2")
+			}
+
+			for i := 0; i != 20; i++ {
+				cache.Lookup(ctx, "cold-"+strconv.Itoa(i))
+			}
+
+			recorder.reset()
+			cache.Lookup(ctx, "hot-1")
+			cache.Lookup(ctx, "hot-2")
+
+			if n := len(recorder.lookups); n != 0 {
+				t.Error("frequently used entries were evicted:", n, "lookups")
+			}
+
+			if stats := cache.Stats(); stats.Rejections != 20 {
+				t.Errorf("bad stats: %+v", stats)
+			}
+		})
+	}
+}
+
+func TestCacheTTLPolicy(t *testing.T) {
+	recorder := &lookupRecorder{registry: registry{
+		"critical": {"localhost:4000"},
+		"batch":    {"localhost:4001"},
+		"other":    {"localhost:4002"},
+	}}
+
+	cache := &Cache{
+		Registry: recorder,
+		TTLPolicy: func(name string, tags []string, ttl time.Duration) (time.Duration, bool) {
+			switch name {
+			case "critical":
+				return time.Nanosecond, true
+			case "batch":
+				return time.Minute, false
+			}
+			return ttl, true
+		},
+	}
+	defer cache.Close()
+
+	ctx := context.Background()
+
+	for i := 0; i != 3; i++ {
+		for _, name := range []string{"critical", "batch", "other"} {
+			if _, _, err := cache.Lookup(ctx, name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	counts := map[string]int{}
+	for _, lookup := range recorder.lookups {
+		counts[lookup.name]++
+	}
+
+	expected := map[string]int{"critical": 3, "batch": 3, "other": 1}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("bad number of lookups on the base registry: %v != %v", counts, expected)
+	}
+
+	if stats := cache.Stats(); stats.Size != 1 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	version := int32(0)
+	unblock := make(chan struct{})
+
+	cache := &Cache{
+		Registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+			if atomic.AddInt32(&version, +1) > 1 {
+				<-unblock
+			}
+			return []string{"localhost:" + strconv.Itoa(4000+int(atomic.LoadInt32(&version)))}, 10 * time.Millisecond, nil
+		}),
+		MaxStale: time.Minute,
+	}
+
+	ctx := context.Background()
+	assertCacheLookup(t, cache, "localhost:4001")
+
+	// Wait for the entry to expire, it must still be served while the refresh
+	// is blocked.
+	time.Sleep(20 * time.Millisecond)
+	assertCacheLookup(t, cache, "localhost:4001")
+	assertCacheLookup(t, cache, "localhost:4001")
+	close(unblock)
+
+	for deadline := time.Now().Add(time.Second); cache.Stats().Refreshes == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the cache entry to be refreshed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if addrs, _, _ := cache.Lookup(ctx, "my-service"); addrs[0] != "localhost:4002" {
+		t.Error("cache entry was not refreshed:", addrs)
+	}
+
+	if n := atomic.LoadInt32(&version); n != 2 {
+		t.Error("bad number of lookups on the base registry:", n)
+	}
+
+	if stats := cache.Stats(); stats.StaleHits != 2 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
+
+func TestCacheStaleOnError(t *testing.T) {
+	lookups := int32(0)
+
+	cache := &Cache{
+		Registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+			if atomic.AddInt32(&lookups, +1) > 1 {
+				return nil, 0, errors.New("failed")
+			}
+			return []string{"localhost:4000"}, 10 * time.Millisecond, nil
+		}),
+		MaxStaleOnError: time.Minute,
+		RetryBackoff:    50 * time.Millisecond,
+	}
+
+	assertCacheLookup(t, cache, "localhost:4000")
+	time.Sleep(20 * time.Millisecond)
+
+	// The refresh fails, the previous address is served and no other lookups
+	// are made until the backoff delay expired.
+	assertCacheLookup(t, cache, "localhost:4000")
+	assertCacheLookup(t, cache, "localhost:4000")
+
+	if n := atomic.LoadInt32(&lookups); n != 2 {
+		t.Error("bad number of lookups on the base registry:", n)
+	}
+
+	// Retries are made in the background, the previous address is served
+	// without waiting for the base registry.
+	time.Sleep(60 * time.Millisecond)
+	assertCacheLookup(t, cache, "localhost:4000")
+
+	for deadline := time.Now().Add(time.Second); cache.Stats().Errors != 2; {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the refresh to be retried")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if n := atomic.LoadInt32(&lookups); n != 3 {
+		t.Error("bad number of lookups on the base registry:", n)
+	}
+
+	if stats := cache.Stats(); stats.Errors != 2 || stats.StaleHits != 3 {
+		t.Errorf("bad stats: %+v", stats)
+	}
+}
+
+func TestCacheStaleOnErrorTimeout(t *testing.T) {
+	lookups := int32(0)
+
+	cache := &Cache{
+		Registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+			if atomic.AddInt32(&lookups, +1) > 1 {
+				<-ctx.Done()
+				return nil, 0, ctx.Err()
+			}
+			return []string{"localhost:4000"}, 10 * time.Millisecond, nil
+		}),
+		MaxStaleOnError: time.Minute,
+		LookupTimeout:   100 * time.Millisecond,
+		RetryBackoff:    time.Millisecond,
+	}
+	defer cache.Close()
+
+	assertCacheLookup(t, cache, "localhost:4000")
+	time.Sleep(20 * time.Millisecond)
+
+	// The base registry hangs, the previous address is served when the
+	// context of the caller ends before the lookup times out.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	addr, err := cache.Resolve(ctx, "my-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr != "localhost:4000" {
+		t.Error("bad address:", addr)
+	}
+
+	// Once the refresh failed, callers do not wait for retries.
+	for deadline := time.Now().Add(time.Second); cache.Stats().Errors != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for the refresh to fail")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	start := time.Now()
+	assertCacheLookup(t, cache, "localhost:4000")
+
+	if elapsed := time.Since(start); elapsed >= 50*time.Millisecond {
+		t.Error("lookup waited for the base registry:", elapsed)
+	}
+}
+
+func TestCacheStaleOnErrorZeroTTL(t *testing.T) {
+	lookups := int32(0)
+
+	cache := &Cache{
+		Registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+			if atomic.AddInt32(&lookups, +1) > 1 {
+				return []string{"localhost:4001"}, 0, nil
+			}
+			return []string{"localhost:4000"}, 10 * time.Millisecond, nil
+		}),
+		MaxStaleOnError: time.Minute,
+	}
+	defer cache.Close()
+
+	assertCacheLookup(t, cache, "localhost:4000")
+	time.Sleep(20 * time.Millisecond)
+
+	// The refreshed entry expires right away, it must still be returned
+	// instead of being refreshed again until the context is canceled.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	addrs, _, err := cache.Lookup(ctx, "my-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(addrs) != 1 || addrs[0] != "localhost:4001" {
+		t.Error("bad addresses:", addrs)
+	}
+
+	if n := atomic.LoadInt32(&lookups); n != 2 {
+		t.Error("bad number of lookups on the base registry:", n)
+	}
+}
+
+func TestCacheNegativeTTL(t *testing.T) {
+	cache := &Cache{
+		MinTTL:         1 * time.Second,
+		MaxTTL:         1 * time.Minute,
+		EmptyTTL:       2 * time.Second,
+		UnreachableTTL: 3 * time.Second,
+		ErrorTTL:       4 * time.Second,
+	}
+
+	tests := []struct {
+		scenario string
+		addrs    []string
+		ttl      time.Duration
+		err      error
+		expect   time.Duration
+	}{
+		{
+			scenario: "success",
+			addrs:    []string{"localhost:4000"},
+			ttl:      time.Hour,
+			expect:   time.Minute,
+		},
+
+		{
+			scenario: "empty",
+			ttl:      time.Hour,
+			expect:   2 * time.Second,
+		},
+
+		{
+			scenario: "unreachable",
+			ttl:      time.Hour,
+			err:      unreachable{},
+			expect:   3 * time.Second,
+		},
+
+		{
+			scenario: "error",
+			ttl:      time.Hour,
+			err:      errors.New("failed"),
+			expect:   4 * time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			if ttl, _ := cache.ttl("my-service", nil, test.addrs, test.ttl, test.err); ttl != test.expect {
+				t.Errorf("bad TTL: %s != %s", ttl, test.expect)
+			}
+		})
+	}
+
+	t.Run("jitter", func(t *testing.T) {
+		cache := &Cache{Jitter: 0.1}
+
+		for i := 0; i != 100; i++ {
+			if ttl, _ := cache.ttl("my-service", nil, nil, time.Second, nil); ttl < 900*time.Millisecond || ttl > time.Second {
+				t.Fatal("TTL out of the jitter bounds:", ttl)
+			}
+		}
+	})
+}
+
+func TestCacheLookupTimeout(t *testing.T) {
+	cache := &Cache{
+		Registry:      hungRegistry(),
+		LookupTimeout: 10 * time.Millisecond,
+	}
+	defer cache.Close()
+
+	_, _, err := cache.Lookup(context.Background(), "my-service")
+	if !isTimeout(err) {
+		t.Errorf("expected a timeout error but got %#v (%s)", err, err)
+	}
+}
+
+func TestCacheMaxConcurrentLookups(t *testing.T) {
+	inflight := int32(0)
+	maxInflight := int32(0)
+
+	cache := &Cache{
+		Registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+			n := atomic.AddInt32(&inflight, +1)
+			defer atomic.AddInt32(&inflight, -1)
+
+			for {
+				max := atomic.LoadInt32(&maxInflight)
+				if n <= max || atomic.CompareAndSwapInt32(&maxInflight, max, n) {
+					break
+				}
+			}
+
+			time.Sleep(time.Millisecond)
+			return []string{"localhost:4000"}, time.Second, nil
+		}),
+		MaxConcurrentLookups: 2,
+	}
+	defer cache.Close()
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i != 20; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if _, _, err := cache.Lookup(context.Background(), name); err != nil {
+				t.Error(err)
+			}
+		}("service-" + strconv.Itoa(i))
+	}
+
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&maxInflight); n > 2 {
+		t.Error("too many concurrent lookups on the base registry:", n)
+	}
+}
+
+func TestCacheClose(t *testing.T) {
+	cache := &Cache{
+		Registry: hungRegistry(),
+	}
+
+	errc := make(chan error)
+	go func() {
+		_, _, err := cache.Lookup(context.Background(), "my-service")
+		errc <- err
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	cache.Close()
+
+	select {
+	case err := <-errc:
+		if !isCanceled(err) {
+			t.Errorf("expected a canceled error but got %#v (%s)", err, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("timeout waiting for the lookup to be canceled")
+	}
+
+	t.Run("fresh entries are not served after the cache was closed", func(t *testing.T) {
+		cache := &Cache{Registry: registry{"my-service": {"localhost:4000"}}}
+		assertCacheLookup(t, cache, "localhost:4000")
+		cache.Close()
+
+		if _, _, err := cache.Lookup(context.Background(), "my-service"); !isCanceled(err) {
+			t.Errorf("expected a canceled error but got %#v (%s)", err, err)
+		}
+	})
+
+	t.Run("lookups in flight complete before the cache is closed", func(t *testing.T) {
+		done := int32(0)
+
+		cache := &Cache{
+			Registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+				time.Sleep(50 * time.Millisecond) // ignores cancellation
+				atomic.StoreInt32(&done, 1)
+				return nil, 0, ctx.Err()
+			}),
+		}
+
+		go cache.Lookup(context.Background(), "my-service")
+		time.Sleep(10 * time.Millisecond)
+		cache.Close()
+
+		if atomic.LoadInt32(&done) != 1 {
+			t.Error("the cache was closed before the lookup on the base registry returned")
+		}
+	})
+}
+
+func TestCacheInvalidate(t *testing.T) {
+	recorder := &lookupRecorder{
+		registry: registry{"service-1": {"localhost:4000"}, "service-2": {"localhost:4001"}},
+	}
+
+	cache := &Cache{Registry: recorder}
+	defer cache.Close()
+
+	ctx := context.Background()
+
+	err := cache.Preload(ctx,
+		CacheQuery{Name: "service-1"},
+		CacheQuery{Name: "service-1", Tags: []string{"A"}},
+		CacheQuery{Name: "service-2"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := cache.Stats(); stats.Size != 3 || stats.Misses != 3 {
+		t.Errorf("bad stats after preloading the cache: %+v", stats)
+	}
+
+	cache.InvalidateTags("service-1", "A")
+	cache.Lookup(ctx, "service-1")
+	cache.Lookup(ctx, "service-1", "A")
+
+	if n := len(recorder.lookups); n != 4 {
+		t.Error("bad number of lookups after invalidating tags:", n)
+	}
+
+	cache.Invalidate("service-1")
+	cache.Lookup(ctx, "service-1")
+	cache.Lookup(ctx, "service-1", "A")
+
+	if n := len(recorder.lookups); n != 6 {
+		t.Error("bad number of lookups after invalidating a service:", n)
+	}
+
+	cache.Purge()
+
+	if stats := cache.Stats(); stats.Size != 0 || stats.Bytes != 0 || stats.Evictions != stats.Misses {
+		t.Errorf("bad stats after purging the cache: %+v", stats)
+	}
+}
+
+func hungRegistry() Registry {
+	return registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	})
+}
+
+func TestCacheSubscribe(t *testing.T) {
+	tests := []struct {
+		scenario string
+		maxStale time.Duration
+	}{
+		{scenario: "entries refreshed after they expired"},
+		{scenario: "entries refreshed in the background", maxStale: time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			version := int32(0)
+
+			cache := &Cache{
+				Registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+					n := int(atomic.AddInt32(&version, +1))
+					return []string{
+						"localhost:" + strconv.Itoa(4000+n),
+						"localhost:" + strconv.Itoa(4001+n),
+					}, 10 * time.Millisecond, nil
+				}),
+				MaxStale: test.maxStale,
+			}
+			defer cache.Close()
+
+			updates := make(chan CacheUpdate, 10)
+			unsubscribe := cache.Subscribe(func(u CacheUpdate) { updates <- u })
+
+			cache.Lookup(context.Background(), "my-service", "A")
+			time.Sleep(20 * time.Millisecond)
+			cache.Lookup(context.Background(), "my-service", "A")
+
+			select {
+			case u := <-updates:
+				expected := CacheUpdate{
+					Name:    "my-service",
+					Tags:    []string{"A"},
+					Added:   []string{"localhost:4003"},
+					Removed: []string{"localhost:4001"},
+				}
+				if !reflect.DeepEqual(u, expected) {
+					t.Errorf("bad update:\n- expected: %+v\n- found:    %+v", expected, u)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for the cache update")
+			}
+
+			unsubscribe()
+			time.Sleep(20 * time.Millisecond)
+			cache.Lookup(context.Background(), "my-service", "A")
+			time.Sleep(20 * time.Millisecond)
+
+			select {
+			case u := <-updates:
+				t.Errorf("unexpected update after unsubscribing: %+v", u)
+			default:
+			}
+		})
+	}
+}
+
+func TestCacheSubscribeUnreachable(t *testing.T) {
+	tests := []struct {
+		scenario string
+		maxStale time.Duration
+	}{
+		{scenario: "entries refreshed after they expired"},
+		{scenario: "entries refreshed in the background", maxStale: time.Minute},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			lookups := int32(0)
+
+			cache := &Cache{
+				Registry: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+					if atomic.AddInt32(&lookups, +1) > 1 {
+						return nil, 0, unreachable{}
+					}
+					return []string{"localhost:4000", "localhost:4001"}, 10 * time.Millisecond, nil
+				}),
+				MaxStale: test.maxStale,
+			}
+			defer cache.Close()
+
+			updates := make(chan CacheUpdate, 10)
+			cache.Subscribe(func(u CacheUpdate) { updates <- u })
+
+			cache.Lookup(context.Background(), "my-service")
+			time.Sleep(20 * time.Millisecond)
+			cache.Lookup(context.Background(), "my-service")
+
+			select {
+			case u := <-updates:
+				sort.Strings(u.Removed)
+				if u.Name != "my-service" || len(u.Added) != 0 || !reflect.DeepEqual(u.Removed, []string{"localhost:4000", "localhost:4001"}) {
+					t.Errorf("bad update: %+v", u)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("timeout waiting for the cache update")
+			}
+		})
+	}
+}
+
+func assertCacheLookup(t *testing.T, cache *Cache, addr string) {
+	t.Helper()
+
+	addrs, _, err := cache.Lookup(context.Background(), "my-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(addrs) != 1 || addrs[0] != addr {
+		t.Errorf("bad addresses: %v != [%s]", addrs, addr)
+	}
+}
+
 func BenchmarkCache(b *testing.B) {
 	benchmarkResolver(b, func(services map[string][]string) (Resolver, func()) {
 		return &Cache{Registry: registry(services)}, func() {}
 	})
 }
 
+// BenchmarkCacheParallel measures the lock contention of the cache when many
+// services are resolved concurrently, comparing a cache with a single lock to
+// one split into the default number of shards, when lookups are spread over
+// many names and when they all resolve the same hot name.
+func BenchmarkCacheParallel(b *testing.B) {
+	services := make(map[string][]string, 1000)
+	names := make([]string, 0, 1000)
+
+	for i := 0; i != 1000; i++ {
+		name := "service-" + strconv.Itoa(i)
+		services[name] = []string{"localhost:4000", "localhost:4001"}
+		names = append(names, name)
+	}
+
+	for _, workload := range []struct {
+		scenario string
+		names    []string
+	}{
+		{scenario: "many names", names: names},
+		{scenario: "hot name", names: names[:1]},
+	} {
+		for _, test := range []struct {
+			scenario string
+			shards   int
+		}{
+			{scenario: "single lock", shards: 1},
+			{scenario: "sharded locks", shards: 0},
+		} {
+			b.Run(workload.scenario+"/"+test.scenario, func(b *testing.B) {
+				cache := &Cache{
+					Registry:           registry(services),
+					Shards:             test.shards,
+					FrequencyAdmission: true,
+				}
+				defer cache.Close()
+
+				ctx := context.Background()
+				names := workload.names
+
+				for _, name := range names {
+					cache.Resolve(ctx, name)
+				}
+
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					for i := 0; pb.Next(); i++ {
+						cache.Resolve(ctx, names[i%len(names)])
+					}
+				})
+			})
+		}
+	}
+}
+
 type registry map[string][]string
 
 func (r registry) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -60,9 +61,30 @@ type Dialer struct {
 	KeepAlive time.Duration
 
 	// Resolver optionally specifies an alternate resolver to use.
+	//
+	// If the resolver implements the DialObserver interface, it is notified
+	// of the outcome of connections made to the addresses that it returned.
 	Resolver Resolver
 }
 
+// DialObserver is an interface implemented by resolvers (and the balancers that
+// they use) which adjust their choices based on the outcome of connections made
+// to the addresses that they returned, like LeastLoaded.
+//
+// DialObserver implementations must be safe to use concurrently from multiple
+// goroutines.
+type DialObserver interface {
+	// ObserveDial is called by Dialer after dialing addr, an address that the
+	// service name was resolved to, with the time it took and the error that
+	// occurred, if any. Dials canceled by the caller are not observed.
+	//
+	// When the connection was established, the returned function, if not nil,
+	// is called after the connection is closed. The connection returned by
+	// Dialer is then a wrapper, TCP and unix connections retain their methods
+	// but are not of type *net.TCPConn or *net.UnixConn.
+	ObserveDial(name string, addr string, rtt time.Duration, err error) (closed func())
+}
+
 // Dial connects to the address on the named network.
 //
 // See https://golang.org/pkg/net/#Dialer.Dial for more details,
@@ -75,6 +97,9 @@ func (d *Dialer) Dial(network, address string) (net.Conn, error) {
 //
 // See https://golang.org/pkg/net/#Dialer.DialContext for more details.
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var observer DialObserver
+	var name string
+
 	host, _, err := net.SplitHostPort(address)
 
 	if err != nil || net.ParseIP(host) == nil {
@@ -84,10 +109,12 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 			resolver = DefaultResolver
 		}
 
-		target, err := resolver.Resolve(ctx, nameOnly(address))
+		name = nameOnly(address)
+		target, err := resolver.Resolve(ctx, name)
 		switch {
 		case err == nil:
 			address = target
+			observer, _ = resolver.(DialObserver)
 		case isUnreachable(err):
 		default:
 			return nil, err
@@ -103,10 +130,73 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 		KeepAlive:     d.KeepAlive,
 	}
 
+	start := time.Now()
 	conn, err := dialer.DialContext(ctx, network, address)
+
+	// The net package does not return context.Canceled when the dial is
+	// canceled, the context tells whether the error came from the caller.
+	canceled := err != nil && (isCanceled(err) || ctx.Err() == context.Canceled)
+
+	if observer != nil && !canceled {
+		if closed := observer.ObserveDial(name, address, time.Since(start), err); closed != nil && err == nil {
+			conn = observeConn(conn, closed)
+		}
+	}
+
 	return conn, wrapError(err)
 }
 
+// observeConn wraps conn to call the function returned by a dial observer when
+// it is closed.
+//
+// TCP and unix connections are embedded in wrappers which retain their methods,
+// so CloseWrite, SetKeepAlive or File remain available to type assertions, and
+// io.Copy still uses their ReadFrom method. The returned connection is not a
+// *net.TCPConn or *net.UnixConn however.
+func observeConn(conn net.Conn, closed func()) net.Conn {
+	switch c := conn.(type) {
+	case *net.TCPConn:
+		return &observedTCPConn{TCPConn: c, closer: connCloser{closed: closed}}
+	case *net.UnixConn:
+		return &observedUnixConn{UnixConn: c, closer: connCloser{closed: closed}}
+	default:
+		return &observedConn{Conn: c, closer: connCloser{closed: closed}}
+	}
+}
+
+type observedConn struct {
+	net.Conn
+	closer connCloser
+}
+
+func (c *observedConn) Close() error { return c.closer.close(c.Conn.Close()) }
+
+type observedTCPConn struct {
+	*net.TCPConn
+	closer connCloser
+}
+
+func (c *observedTCPConn) Close() error { return c.closer.close(c.TCPConn.Close()) }
+
+type observedUnixConn struct {
+	*net.UnixConn
+	closer connCloser
+}
+
+func (c *observedUnixConn) Close() error { return c.closer.close(c.UnixConn.Close()) }
+
+// connCloser calls the function returned by a dial observer once, after the
+// connection was closed.
+type connCloser struct {
+	once   sync.Once
+	closed func()
+}
+
+func (c *connCloser) close(err error) error {
+	c.once.Do(c.closed)
+	return err
+}
+
 func nameOnly(address string) string {
 	name, _, err := net.SplitHostPort(address)
 	if err != nil {
@@ -1,11 +1,14 @@
 package services
 
 import (
+	"context"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestDialer(t *testing.T) {
@@ -32,6 +35,16 @@ func TestDialer(t *testing.T) {
 			scenario: "dialing an address where no server is listening returns an unreachable error",
 			function: testDialerNoListener,
 		},
+
+		{
+			scenario: "dials canceled by the caller are not reported to the dial observer",
+			function: testDialerCanceled,
+		},
+
+		{
+			scenario: "observed TCP connections retain the methods of TCP connections",
+			function: testDialerObservedTCPConn,
+		},
 	}
 
 	for _, test := range tests {
@@ -114,3 +127,103 @@ func testDialerNoListener(t *testing.T) {
 		t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
 	}
 }
+
+func testDialerCanceled(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	r := &dialObserverFunc{
+		resolve: func(ctx context.Context, name string) (string, error) {
+			return l.Addr().String(), nil
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = (&Dialer{Resolver: r}).DialContext(ctx, "tcp", "service:80")
+	if err == nil {
+		t.Fatal("expected an error but got nil")
+	}
+
+	if r.observed != 0 {
+		t.Error("the canceled dial was observed")
+	}
+}
+
+func testDialerObservedTCPConn(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	r := &dialObserverFunc{
+		resolve: func(ctx context.Context, name string) (string, error) {
+			return l.Addr().String(), nil
+		},
+	}
+
+	c, err := (&Dialer{Resolver: r}).Dial("tcp", "service:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cw, ok := c.(interface{ CloseWrite() error })
+	if !ok {
+		t.Fatalf("%T does not implement CloseWrite", c)
+	}
+
+	if _, ok := c.(io.ReaderFrom); !ok {
+		t.Errorf("%T does not implement io.ReaderFrom", c)
+	}
+
+	c.Write([]byte("Hello World!"))
+
+	if err := cw.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server reads until EOF, which it only gets if the write side of the
+	// connection was closed.
+	b, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != "Hello World!" {
+		t.Error("bad data received by the server:", string(b))
+	}
+
+	c.Close()
+	c.Close()
+
+	if r.closed != 1 {
+		t.Error("bad number of calls to the function returned by the dial observer:", r.closed)
+	}
+}
+
+type dialObserverFunc struct {
+	resolve  func(context.Context, string) (string, error)
+	observed int
+	closed   int
+}
+
+func (r *dialObserverFunc) Resolve(ctx context.Context, name string) (string, error) {
+	return r.resolve(ctx, name)
+}
+
+func (r *dialObserverFunc) ObserveDial(name string, addr string, rtt time.Duration, err error) func() {
+	r.observed++
+	return func() { r.closed++ }
+}
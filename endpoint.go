@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Endpoint carries the address of a service instance, along with metadata that
+// the registry exposes about it.
+type Endpoint struct {
+	// The address at which the instance can be reached.
+	Addr string
+
+	// The weight of the instance, relative to other instances of the service.
+	// Zero means that the weight is taken from a "weight=N" tag, or defaults
+	// to 1.
+	Weight int
+
+	// Tags of the instance, as registered in the service discovery backend.
+	Tags []string
+}
+
+// EndpointRegistry is an interface implemented by registries which expose
+// metadata about the addresses of services, like their weight.
+//
+// Cache and RegistryResolver use the LookupEndpoints method instead of Lookup
+// when the base registry implements the interface, and give the weights of the
+// addresses to balancers implementing WeightedBalancer.
+type EndpointRegistry interface {
+	Registry
+
+	// LookupEndpoints is like Lookup but returns endpoints instead of bare
+	// addresses.
+	LookupEndpoints(ctx context.Context, name string, tags ...string) (endpoints []Endpoint, ttl time.Duration, err error)
+}
+
+// NewRegistry returns a value implementing the EndpointRegistry interface using
+// the given standard resolver.
+//
+// Service names are looked up with the LookupSRV method, the weights of SRV
+// records are exposed as the weights of the endpoints. Because the standard
+// resolver does not expose the TTLs of DNS records, lookups always return a
+// zero TTL. Tags are not supported by DNS and are ignored.
+//
+// If r is nil, net.DefaultResolver is used.
+func NewRegistry(r *net.Resolver) EndpointRegistry {
+	return srvRegistry{r}
+}
+
+type srvRegistry struct {
+	*net.Resolver
+}
+
+func (r srvRegistry) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+	endpoints, ttl, err := r.LookupEndpoints(ctx, name, tags...)
+	if err != nil {
+		return nil, ttl, err
+	}
+
+	addrs := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		addrs[i] = e.Addr
+	}
+
+	return addrs, ttl, nil
+}
+
+func (r srvRegistry) LookupEndpoints(ctx context.Context, name string, tags ...string) ([]Endpoint, time.Duration, error) {
+	rslv := r.Resolver
+
+	if rslv == nil {
+		rslv = net.DefaultResolver
+	}
+
+	_, srv, err := rslv.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, 0, wrapError(err)
+	}
+
+	endpoints := make([]Endpoint, len(srv))
+
+	for i, s := range srv {
+		host := strings.TrimSuffix(s.Target, ".")
+		port := strconv.Itoa(int(s.Port))
+		endpoints[i] = Endpoint{
+			Addr:   net.JoinHostPort(host, port),
+			Weight: int(s.Weight),
+		}
+	}
+
+	return endpoints, 0, nil
+}
+
+// weight returns the weight of e, taken from the Weight field, or from a
+// "weight=N" tag, defaulting to 1.
+func (e *Endpoint) weight() int {
+	if e.Weight > 0 {
+		return e.Weight
+	}
+
+	for _, tag := range e.Tags {
+		if strings.HasPrefix(tag, "weight=") {
+			if w, err := strconv.Atoi(tag[7:]); err == nil && w > 0 {
+				return w
+			}
+		}
+	}
+
+	return 1
+}
+
+// lookupEndpoints looks up the addresses of a service in r, and their weights
+// if r implements EndpointRegistry (the weights are nil otherwise).
+func lookupEndpoints(ctx context.Context, r Registry, name string, tags ...string) ([]string, map[string]int, time.Duration, error) {
+	er, ok := r.(EndpointRegistry)
+	if !ok {
+		addrs, ttl, err := r.Lookup(ctx, name, tags...)
+		return addrs, nil, ttl, err
+	}
+
+	endpoints, ttl, err := er.LookupEndpoints(ctx, name, tags...)
+	if err != nil {
+		return nil, nil, ttl, err
+	}
+
+	addrs := make([]string, len(endpoints))
+	weights := make(map[string]int, len(endpoints))
+
+	for i := range endpoints {
+		addrs[i] = endpoints[i].Addr
+		weights[addrs[i]] = endpoints[i].weight()
+	}
+
+	return addrs, weights, ttl, nil
+}
+
+// weightsOf returns the weights of addrs, or nil if weights is nil.
+func weightsOf(addrs []string, weights map[string]int) []int {
+	if weights == nil {
+		return nil
+	}
+
+	w := make([]int, len(addrs))
+	for i, addr := range addrs {
+		if w[i] = weights[addr]; w[i] <= 0 {
+			w[i] = 1
+		}
+	}
+	return w
+}
+
+func equalWeights(a, b map[string]int) bool {
+	if len(a) != len(b) || (a == nil) != (b == nil) {
+		return false
+	}
+	for addr, w := range a {
+		if b[addr] != w {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewRegistry(t *testing.T) {
+	server := dnsServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		a := &dns.Msg{}
+		a.SetReply(r)
+
+		if r.Question[0].Qtype == dns.TypeSRV && strings.HasPrefix(r.Question[0].Name, "my-service.") {
+			for port, weight := range map[uint16]uint16{4000: 1, 4001: 3} {
+				a.Answer = append(a.Answer, &dns.SRV{
+					Hdr: dns.RR_Header{
+						Name:   r.Question[0].Name,
+						Rrtype: dns.TypeSRV,
+						Class:  dns.ClassINET,
+						Ttl:    10,
+					},
+					Priority: 1,
+					Weight:   weight,
+					Port:     port,
+					Target:   "localhost.",
+				})
+			}
+		} else {
+			a.Rcode = dns.RcodeNameError
+		}
+
+		w.WriteMsg(a)
+	})
+	defer server.Shutdown()
+
+	r := NewRegistry(&net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, server.Net, server.Addr)
+		},
+	})
+
+	endpoints, _, err := r.LookupEndpoints(context.Background(), "my-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	weights := make(map[string]int)
+	for _, e := range endpoints {
+		weights[e.Addr] = e.Weight
+	}
+
+	if !reflect.DeepEqual(weights, map[string]int{"localhost:4000": 1, "localhost:4001": 3}) {
+		t.Error("bad endpoints:", endpoints)
+	}
+
+	addrs, _, err := r.Lookup(context.Background(), "my-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(sortedStrings(addrs), []string{"localhost:4000", "localhost:4001"}) {
+		t.Error("bad addresses:", addrs)
+	}
+
+	if _, _, err := r.Lookup(context.Background(), "other-service"); !isUnreachable(err) {
+		t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+	}
+}
+
+func TestEndpointWeight(t *testing.T) {
+	tests := []struct {
+		endpoint Endpoint
+		weight   int
+	}{
+		{Endpoint{Addr: "localhost:4000"}, 1},
+		{Endpoint{Addr: "localhost:4000", Weight: 3}, 3},
+		{Endpoint{Addr: "localhost:4000", Tags: []string{"zone=a", "weight=5"}}, 5},
+		{Endpoint{Addr: "localhost:4000", Weight: 2, Tags: []string{"weight=5"}}, 2},
+		{Endpoint{Addr: "localhost:4000", Tags: []string{"weight=nope"}}, 1},
+		{Endpoint{Addr: "localhost:4000", Tags: []string{"weight=-1"}}, 1},
+	}
+
+	for _, test := range tests {
+		if weight := test.endpoint.weight(); weight != test.weight {
+			t.Errorf("%+v: weight = %d, want %d", test.endpoint, weight, test.weight)
+		}
+	}
+}
+
+func TestCacheEndpoints(t *testing.T) {
+	base := endpointRegistry{
+		"my-service": {
+			{Addr: "localhost:4000", Weight: 5},
+			{Addr: "localhost:4001", Tags: []string{"weight=2"}},
+		},
+	}
+
+	t.Run("weights are exposed by LookupEndpoints", func(t *testing.T) {
+		cache := &Cache{Registry: base}
+		defer cache.Close()
+
+		endpoints, _, err := cache.LookupEndpoints(context.Background(), "my-service")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if weights := endpointWeights(endpoints); !reflect.DeepEqual(weights, map[string]int{"localhost:4000": 5, "localhost:4001": 2}) {
+			t.Error("bad weights:", weights)
+		}
+	})
+
+	t.Run("weights default to 1 when the base registry does not expose them", func(t *testing.T) {
+		cache := &Cache{Registry: registry{"my-service": {"localhost:4000"}}}
+		defer cache.Close()
+
+		endpoints, _, err := cache.LookupEndpoints(context.Background(), "my-service")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(endpoints, []Endpoint{{Addr: "localhost:4000", Weight: 1}}) {
+			t.Error("bad endpoints:", endpoints)
+		}
+	})
+
+	t.Run("weights are saved in snapshots", func(t *testing.T) {
+		c1 := &Cache{Registry: base}
+		defer c1.Close()
+
+		if _, _, err := c1.Lookup(context.Background(), "my-service"); err != nil {
+			t.Fatal(err)
+		}
+
+		b := &bytes.Buffer{}
+		if err := c1.WriteSnapshot(b); err != nil {
+			t.Fatal(err)
+		}
+
+		c2 := &Cache{Registry: failingRegistry()}
+		defer c2.Close()
+
+		if err := c2.ReadSnapshot(b); err != nil {
+			t.Fatal(err)
+		}
+
+		endpoints, _, err := c2.LookupEndpoints(context.Background(), "my-service")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if weights := endpointWeights(endpoints); !reflect.DeepEqual(weights, map[string]int{"localhost:4000": 5, "localhost:4001": 2}) {
+			t.Error("bad weights:", weights)
+		}
+	})
+}
+
+type endpointRegistry map[string][]Endpoint
+
+func (r endpointRegistry) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+	addrs, _, ttl, err := lookupEndpoints(ctx, r, name, tags...)
+	return addrs, ttl, err
+}
+
+func (r endpointRegistry) LookupEndpoints(ctx context.Context, name string, tags ...string) ([]Endpoint, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	endpoints, ok := r[name]
+	if !ok {
+		return nil, time.Second, unreachable{}
+	}
+
+	return append([]Endpoint{}, endpoints...), time.Second, nil
+}
+
+func endpointWeights(endpoints []Endpoint) map[string]int {
+	weights := make(map[string]int, len(endpoints))
+	for _, e := range endpoints {
+		weights[e.Addr] = e.Weight
+	}
+	return weights
+}
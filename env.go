@@ -0,0 +1,195 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// EnvNaming is a function type implementing conventions to map service names
+// to the values of environment variables.
+//
+// The function receives the service name and a function to read environment
+// variables with, it returns the list of addresses found for the service and
+// a boolean indicating whether the service was found.
+type EnvNaming func(name string, lookupEnv func(string) (string, bool)) (addrs []string, ok bool)
+
+// KubernetesEnv is the naming convention used by Kubernetes, where service
+// addresses are exposed in two environment variables, for example:
+//
+//	API_SERVICE_HOST=10.0.0.11
+//	API_SERVICE_PORT=8080
+//
+// The host variable may contain a comma-separated list of hosts, each of them
+// is combined with the port to form the list of addresses.
+func KubernetesEnv(name string, lookupEnv func(string) (string, bool)) ([]string, bool) {
+	prefix := envName(name) + "_SERVICE_"
+
+	host, ok := lookupEnv(prefix + "HOST")
+	if !ok {
+		return nil, false
+	}
+
+	port, ok := lookupEnv(prefix + "PORT")
+	if !ok {
+		return nil, false
+	}
+
+	hosts := splitEnvList(host)
+	addrs := make([]string, 0, len(hosts))
+
+	for _, h := range hosts {
+		addrs = append(addrs, net.JoinHostPort(h, strings.TrimSpace(port)))
+	}
+
+	return addrs, true
+}
+
+// DockerLinkEnv is the naming convention used by Docker links, where service
+// addresses are exposed as URLs in a single environment variable, for example:
+//
+//	API_PORT=tcp://10.0.0.11:8080
+//
+// The variable may contain a comma-separated list of URLs.
+func DockerLinkEnv(name string, lookupEnv func(string) (string, bool)) ([]string, bool) {
+	value, ok := lookupEnv(envName(name) + "_PORT")
+	if !ok {
+		return nil, false
+	}
+
+	values := splitEnvList(value)
+	addrs := make([]string, 0, len(values))
+
+	for _, v := range values {
+		u, err := url.Parse(v)
+		if err != nil || u.Host == "" {
+			addrs = append(addrs, v)
+		} else {
+			addrs = append(addrs, u.Host)
+		}
+	}
+
+	return addrs, true
+}
+
+// EnvTemplate returns a naming convention where service addresses are exposed
+// in a single environment variable named after the template, which must have
+// a single %s verb where the service name will be inserted. For example, the
+// template "SERVICE_%s_ADDR" maps the "api" service to:
+//
+//	SERVICE_API_ADDR=10.0.0.11:8080
+//
+// The variable may contain a comma-separated list of addresses.
+func EnvTemplate(template string) EnvNaming {
+	return func(name string, lookupEnv func(string) (string, bool)) ([]string, bool) {
+		value, ok := lookupEnv(fmt.Sprintf(template, envName(name)))
+		if !ok {
+			return nil, false
+		}
+		return splitEnvList(value), true
+	}
+}
+
+// EnvRegistry is an implementation of the Registry and Resolver interfaces
+// which translates service names to addresses found in environment variables,
+// a common model of twelve-factor deployments.
+//
+// Service names are converted to upper case and have their dashes and dots
+// replaced by underscores before being passed to the naming convention.
+//
+// Environment variables do not carry tags, lookups with a non-empty list of
+// tags return no addresses.
+type EnvRegistry struct {
+	// Naming convention used to map service names to environment variables.
+	// Defaults to KubernetesEnv.
+	Naming EnvNaming
+
+	// LookupEnv is the function used to read environment variables. Defaults
+	// to os.LookupEnv.
+	LookupEnv func(string) (string, bool)
+
+	// TTL returned by calls to Lookup.
+	TTL time.Duration
+}
+
+// Resolve satisfies the Resolver interface.
+func (r *EnvRegistry) Resolve(ctx context.Context, name string) (string, error) {
+	addrs, _, err := r.Lookup(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
+// Lookup satisfies the Registry interface.
+func (r *EnvRegistry) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if len(tags) != 0 {
+		return nil, 0, &envError{name: name}
+	}
+
+	addrs, ok := r.naming()(name, r.lookupEnv())
+	if !ok || len(addrs) == 0 {
+		return nil, 0, &envError{name: name}
+	}
+
+	return addrs, r.TTL, nil
+}
+
+func (r *EnvRegistry) naming() EnvNaming {
+	if naming := r.Naming; naming != nil {
+		return naming
+	}
+	return KubernetesEnv
+}
+
+func (r *EnvRegistry) lookupEnv() func(string) (string, bool) {
+	if lookupEnv := r.LookupEnv; lookupEnv != nil {
+		return lookupEnv
+	}
+	return os.LookupEnv
+}
+
+type envError struct {
+	name string
+}
+
+func (e *envError) Error() string {
+	return e.name + ": no addresses found in the environment"
+}
+
+func (e *envError) Unreachable() bool {
+	return true
+}
+
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '-', '.':
+			return '_'
+		}
+		return r
+	}, strings.ToUpper(name))
+}
+
+func splitEnvList(s string) []string {
+	list := strings.Split(s, ",")
+	i := 0
+
+	for _, item := range list {
+		if item = strings.TrimSpace(item); item != "" {
+			list[i] = item
+			i++
+		}
+	}
+
+	return list[:i]
+}
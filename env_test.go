@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvRegistry(t *testing.T) {
+	t.Run("resolver", func(t *testing.T) {
+		testResolver(t, func(services map[string][]string) (Resolver, func()) {
+			env := envMap{}
+
+			for name, addrs := range services {
+				env["SERVICE_"+envName(name)+"_ADDR"] = strings.Join(addrs, ",")
+			}
+
+			return &EnvRegistry{
+				Naming:    EnvTemplate("SERVICE_%s_ADDR"),
+				LookupEnv: env.lookupEnv,
+			}, func() {}
+		})
+	})
+
+	tests := []struct {
+		scenario string
+		naming   EnvNaming
+		env      envMap
+		addrs    []string
+	}{
+		{
+			scenario: "kubernetes",
+			naming:   KubernetesEnv,
+			env: envMap{
+				"MY_SERVICE_SERVICE_HOST": "10.0.0.1, 10.0.0.2",
+				"MY_SERVICE_SERVICE_PORT": "8080",
+			},
+			addrs: []string{"10.0.0.1:8080", "10.0.0.2:8080"},
+		},
+
+		{
+			scenario: "kubernetes without port",
+			naming:   KubernetesEnv,
+			env: envMap{
+				"MY_SERVICE_SERVICE_HOST": "10.0.0.1",
+			},
+		},
+
+		{
+			scenario: "docker links",
+			naming:   DockerLinkEnv,
+			env: envMap{
+				"MY_SERVICE_PORT": "tcp://10.0.0.1:5432,tcp://10.0.0.2:5432",
+			},
+			addrs: []string{"10.0.0.1:5432", "10.0.0.2:5432"},
+		},
+
+		{
+			scenario: "template",
+			naming:   EnvTemplate("SERVICE_%s_ADDR"),
+			env: envMap{
+				"SERVICE_MY_SERVICE_ADDR": "10.0.0.1:4242",
+			},
+			addrs: []string{"10.0.0.1:4242"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			r := &EnvRegistry{
+				Naming:    test.naming,
+				LookupEnv: test.env.lookupEnv,
+			}
+
+			addrs, _, err := r.Lookup(context.Background(), "my-service")
+
+			if test.addrs == nil {
+				if !isUnreachable(err) {
+					t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(addrs, test.addrs) {
+				t.Error("addresses mismatch:")
+				t.Log("expected:", test.addrs)
+				t.Log("found:   ", addrs)
+			}
+		})
+	}
+}
+
+type envMap map[string]string
+
+func (env envMap) lookupEnv(name string) (string, bool) {
+	value, ok := env[name]
+	return value, ok
+}
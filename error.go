@@ -12,6 +12,10 @@ type errorCause interface {
 	Cause() error
 }
 
+type errorCanceled interface {
+	Canceled() bool
+}
+
 type errorTemporary interface {
 	Temporary() bool
 }
@@ -24,6 +28,10 @@ type errorUnreachable interface {
 	Unreachable() bool
 }
 
+type errorValidation interface {
+	Validation() bool
+}
+
 type wrappedError struct {
 	cause error
 }
@@ -56,6 +64,8 @@ func isCanceled(err error) bool {
 			return isCanceledDNSError(e)
 		case *net.OpError:
 			return isCanceled(e.Err)
+		case errorCanceled:
+			return e.Canceled()
 		case errorCause:
 			return isCanceled(e.Cause())
 		default:
@@ -141,6 +151,8 @@ func isValidation(err error) bool {
 			return isValidation(e.Err)
 		case syscall.Errno:
 			return isValidationErrno(e)
+		case errorValidation:
+			return e.Validation()
 		case errorCause:
 			return isValidation(e.Cause())
 		default:
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"context"
+	"time"
+)
+
+// FallbackResolver is an implementation of the Resolver interface which tries
+// a list of resolvers in order, moving on to the next one when a resolver
+// returns an unreachable error or an empty address.
+//
+// Other errors, like cancellation and validation errors, are returned
+// immediately since trying other resolvers would fail the same way. The error
+// of the last resolver is returned if none of them succeeded, or an unreachable
+// error if the last resolver returned an empty address.
+type FallbackResolver struct {
+	// List of resolvers to try, in order.
+	Resolvers []Resolver
+
+	// Answered is called, if not nil, with the index of the resolver which the
+	// result of a successful call to Resolve came from.
+	Answered func(name string, index int)
+}
+
+// Resolve satisfies the Resolver interface.
+func (f *FallbackResolver) Resolve(ctx context.Context, name string) (string, error) {
+	var addr string
+	var err error = &fallbackError{name: name}
+	var index int
+
+	for i, r := range f.Resolvers {
+		if err := ctx.Err(); err != nil {
+			return "", err
+		}
+
+		addr, err = r.Resolve(ctx, name)
+		index = i
+
+		if !shouldFallback(err, addr == "") {
+			break
+		}
+	}
+
+	if err == nil && addr == "" {
+		err = &fallbackError{name: name}
+	}
+
+	if err == nil && f.Answered != nil {
+		f.Answered(name, index)
+	}
+
+	return addr, err
+}
+
+// FallbackRegistry is an implementation of the Registry interface which tries
+// a list of registries in order, moving on to the next one when a registry
+// returns an unreachable error or no addresses.
+//
+// Other errors, like cancellation and validation errors, are returned
+// immediately since trying other registries would fail the same way. The error
+// of the last registry is returned if none of them succeeded, or an unreachable
+// error if the last registry returned no addresses.
+type FallbackRegistry struct {
+	// List of registries to try, in order.
+	Registries []Registry
+
+	// Answered is called, if not nil, with the index of the registry which the
+	// result of a successful call to Lookup came from.
+	Answered func(name string, index int)
+}
+
+// Lookup satisfies the Registry interface.
+func (f *FallbackRegistry) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+	var addrs []string
+	var ttl time.Duration
+	var err error = &fallbackError{name: name}
+	var index int
+
+	for i, r := range f.Registries {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+
+		addrs, ttl, err = r.Lookup(ctx, name, tags...)
+		index = i
+
+		if !shouldFallback(err, len(addrs) == 0) {
+			break
+		}
+	}
+
+	if err == nil && len(addrs) == 0 {
+		addrs, ttl, err = nil, 0, &fallbackError{name: name}
+	}
+
+	if err == nil && f.Answered != nil {
+		f.Answered(name, index)
+	}
+
+	return addrs, ttl, err
+}
+
+// shouldFallback returns true if the result of a resolver or registry should
+// be discarded in favor of the next one.
+func shouldFallback(err error, empty bool) bool {
+	if err != nil {
+		return isUnreachable(err)
+	}
+	return empty
+}
+
+type fallbackError struct {
+	name string
+}
+
+func (e *fallbackError) Error() string {
+	return e.name + ": no resolvers or registries to fall back to"
+}
+
+func (e *fallbackError) Unreachable() bool {
+	return true
+}
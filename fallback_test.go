@@ -0,0 +1,200 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFallbackResolver(t *testing.T) {
+	t.Run("resolver", func(t *testing.T) {
+		testResolver(t, func(services map[string][]string) (Resolver, func()) {
+			return &FallbackResolver{
+				Resolvers: []Resolver{
+					&EnvRegistry{LookupEnv: envMap{}.lookupEnv},
+					&Cache{Registry: registry(services)},
+				},
+			}, func() {}
+		})
+	})
+
+	t.Run("validation errors stop the fallback chain", func(t *testing.T) {
+		answered := -1
+
+		r := &FallbackResolver{
+			Resolvers: []Resolver{
+				&EnvRegistry{LookupEnv: envMap{}.lookupEnv},
+				resolverFunc(func(ctx context.Context, name string) (string, error) {
+					return "", &net.AddrError{Err: "invalid address"}
+				}),
+				resolverFunc(func(ctx context.Context, name string) (string, error) {
+					return "localhost:4242", nil
+				}),
+			},
+			Answered: func(name string, index int) { answered = index },
+		}
+
+		_, err := r.Resolve(context.Background(), "my-service")
+		if !isValidation(err) {
+			t.Errorf("expected a validation error but got %#v (%s)", err, err)
+		}
+
+		if answered != -1 {
+			t.Error("the resolver which failed was reported to have answered:", answered)
+		}
+	})
+
+	t.Run("an unreachable error is returned when all resolvers return empty addresses", func(t *testing.T) {
+		answered := -1
+
+		r := &FallbackResolver{
+			Resolvers: []Resolver{
+				resolverFunc(func(ctx context.Context, name string) (string, error) {
+					return "", nil
+				}),
+				resolverFunc(func(ctx context.Context, name string) (string, error) {
+					return "", nil
+				}),
+			},
+			Answered: func(name string, index int) { answered = index },
+		}
+
+		_, err := r.Resolve(context.Background(), "my-service")
+		if !isUnreachable(err) {
+			t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+		}
+
+		if answered != -1 {
+			t.Error("a resolver which returned an empty address was reported to have answered:", answered)
+		}
+	})
+}
+
+func TestFallbackRegistry(t *testing.T) {
+	t.Run("empty results and unreachable errors move to the next registry", func(t *testing.T) {
+		answered := -1
+
+		r := &FallbackRegistry{
+			Registries: []Registry{
+				registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+					return nil, time.Second, nil
+				}),
+				registry{},
+				registry{"my-service": {"localhost:4242"}},
+			},
+			Answered: func(name string, index int) { answered = index },
+		}
+
+		addrs, ttl, err := r.Lookup(context.Background(), "my-service")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(addrs, []string{"localhost:4242"}) {
+			t.Error("bad addresses:", addrs)
+		}
+
+		if ttl != time.Second {
+			t.Error("bad TTL:", ttl)
+		}
+
+		if answered != 2 {
+			t.Error("bad index of the registry which answered:", answered)
+		}
+	})
+
+	t.Run("the result of the last registry is returned when all of them fail", func(t *testing.T) {
+		answered := -1
+
+		r := &FallbackRegistry{
+			Registries: []Registry{
+				registry{},
+				registry{},
+			},
+			Answered: func(name string, index int) { answered = index },
+		}
+
+		_, _, err := r.Lookup(context.Background(), "my-service")
+		if !isUnreachable(err) {
+			t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+		}
+
+		if answered != -1 {
+			t.Error("a registry which failed was reported to have answered:", answered)
+		}
+	})
+
+	t.Run("an unreachable error is returned when all registries return no addresses", func(t *testing.T) {
+		answered := -1
+
+		r := &FallbackRegistry{
+			Registries: []Registry{
+				registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+					return nil, time.Second, nil
+				}),
+				registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+					return []string{}, time.Second, nil
+				}),
+			},
+			Answered: func(name string, index int) { answered = index },
+		}
+
+		_, _, err := r.Lookup(context.Background(), "my-service")
+		if !isUnreachable(err) {
+			t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+		}
+
+		if answered != -1 {
+			t.Error("a registry which returned no addresses was reported to have answered:", answered)
+		}
+	})
+
+	t.Run("errors other than unreachable errors stop the fallback chain", func(t *testing.T) {
+		r := &FallbackRegistry{
+			Registries: []Registry{
+				registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+					return nil, 0, errors.New("failed")
+				}),
+				registry{"my-service": {"localhost:4242"}},
+			},
+		}
+
+		_, _, err := r.Lookup(context.Background(), "my-service")
+		if err == nil || err.Error() != "failed" {
+			t.Errorf("bad error: %#v (%s)", err, err)
+		}
+	})
+
+	t.Run("cancellation errors stop the fallback chain", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		r := &FallbackRegistry{
+			Registries: []Registry{
+				registry{},
+				registry{"my-service": {"localhost:4242"}},
+			},
+		}
+
+		_, _, err := r.Lookup(ctx, "my-service")
+		if !isCanceled(err) {
+			t.Errorf("expected a canceled error but got %#v (%s)", err, err)
+		}
+	})
+
+	t.Run("an empty list of registries returns an unreachable error", func(t *testing.T) {
+		_, _, err := (&FallbackRegistry{}).Lookup(context.Background(), "my-service")
+		if !isUnreachable(err) {
+			t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+		}
+	})
+}
+
+type resolverFunc func(context.Context, string) (string, error)
+
+func (f resolverFunc) Resolve(ctx context.Context, name string) (string, error) {
+	return f(ctx, name)
+}
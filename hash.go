@@ -0,0 +1,321 @@
+package services
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// WithShardKey returns a context carrying a shard key, which consistent hashing
+// balancers (RingHash, Rendezvous, Maglev and JumpHash) use to route the
+// resolution of service names to a stable address.
+func WithShardKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, shardKeyContextKey{}, key)
+}
+
+// ShardKey returns the shard key carried by ctx, and a boolean indicating
+// whether one was found.
+func ShardKey(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(shardKeyContextKey{}).(string)
+	return key, ok
+}
+
+type shardKeyContextKey struct{}
+
+// ResolveKey resolves the service name using r, routing the resolution by key.
+//
+// This is a shorthand for calling r.Resolve with a context carrying the shard
+// key, r is expected to use a consistent hashing balancer to honor it.
+func ResolveKey(ctx context.Context, r Resolver, name string, key string) (string, error) {
+	return r.Resolve(WithShardKey(ctx, key), name)
+}
+
+// RingHash is a consistent hashing Balancer which places the addresses of a
+// service at multiple points of a hash ring, and picks the address following
+// the hash of the shard key on the ring.
+//
+// When addresses are added or removed, only the keys mapped to the ring
+// segments that they own are moved to different addresses.
+//
+// Calls to Resolve with a context that does not carry a shard key return
+// addresses picked at random.
+type RingHash struct {
+	// Number of points placed on the ring for each address, more points give
+	// a more even distribution of keys at the cost of memory. Defaults to 100.
+	VirtualNodes int
+}
+
+// NewPicker satisfies the Balancer interface.
+func (b RingHash) NewPicker(name string, addrs []string, prev Picker) Picker {
+	n := b.VirtualNodes
+	if n <= 0 {
+		n = 100
+	}
+
+	p := &ringHashPicker{
+		addrs:  addrs,
+		points: make([]ringHashPoint, 0, n*len(addrs)),
+	}
+
+	for i, addr := range addrs {
+		for j := 0; j != n; j++ {
+			p.points = append(p.points, ringHashPoint{
+				hash:  hashString(addr + "#" + strconv.Itoa(j)),
+				index: i,
+			})
+		}
+	}
+
+	sort.Slice(p.points, func(i, j int) bool {
+		return p.points[i].hash < p.points[j].hash
+	})
+
+	return p
+}
+
+type ringHashPicker struct {
+	addrs  []string
+	points []ringHashPoint
+}
+
+type ringHashPoint struct {
+	hash  uint64
+	index int
+}
+
+func (p *ringHashPicker) Pick(ctx context.Context) string {
+	key, ok := ShardKey(ctx)
+	if !ok {
+		return p.addrs[rand.Intn(len(p.addrs))]
+	}
+
+	h := hashString(key)
+	i := sort.Search(len(p.points), func(i int) bool { return p.points[i].hash >= h })
+
+	if i == len(p.points) {
+		i = 0
+	}
+
+	return p.addrs[p.points[i].index]
+}
+
+// Rendezvous is a consistent hashing Balancer implementing highest random
+// weight hashing: the address picked for a shard key is the one with the
+// highest score computed by hashing the key together with each address.
+//
+// Only the keys mapped to addresses that are removed are moved, and addresses
+// that are added only take over keys for which they get the highest score.
+// Compared to RingHash, the balancer uses less memory but picking an address
+// takes time proportional to the number of addresses.
+//
+// Calls to Resolve with a context that does not carry a shard key return
+// addresses picked at random.
+type Rendezvous struct{}
+
+// NewPicker satisfies the Balancer interface.
+func (Rendezvous) NewPicker(name string, addrs []string, prev Picker) Picker {
+	p := &rendezvousPicker{
+		addrs:  addrs,
+		hashes: make([]uint64, len(addrs)),
+	}
+
+	for i, addr := range addrs {
+		p.hashes[i] = hashString(addr)
+	}
+
+	return p
+}
+
+type rendezvousPicker struct {
+	addrs  []string
+	hashes []uint64
+}
+
+func (p *rendezvousPicker) Pick(ctx context.Context) string {
+	key, ok := ShardKey(ctx)
+	if !ok {
+		return p.addrs[rand.Intn(len(p.addrs))]
+	}
+
+	h := hashString(key)
+	best, max := 0, uint64(0)
+
+	for i, x := range p.hashes {
+		if score := mix64(x ^ h); score > max {
+			best, max = i, score
+		}
+	}
+
+	return p.addrs[best]
+}
+
+// Maglev is a consistent hashing Balancer using the lookup table described in
+// Maglev: A Fast and Reliable Software Network Load Balancer:
+// https://research.google.com/pubs/pub44824.html
+//
+// Each address fills entries of a fixed size table following its own
+// permutation, picking an address for a shard key is then a single table
+// lookup. Memory usage does not depend on the number of addresses, which
+// makes it a good fit for services with thousands of instances. Membership
+// changes move slightly more keys than with RingHash or Rendezvous.
+//
+// Calls to Resolve with a context that does not carry a shard key return
+// addresses picked at random.
+type Maglev struct {
+	// Size of the lookup table, rounded up to a prime number. It should be
+	// much larger than the number of addresses (at least 100 times) for keys
+	// to be spread evenly. Defaults to 65537.
+	TableSize int
+}
+
+// NewPicker satisfies the Balancer interface.
+func (b Maglev) NewPicker(name string, addrs []string, prev Picker) Picker {
+	size := b.TableSize
+	if size <= 0 {
+		size = 65537
+	}
+	if size < len(addrs) {
+		size = len(addrs)
+	}
+	size = nextPrime(size)
+
+	// The table depends on the order in which addresses fill it, sorting them
+	// makes it the same for all pickers created for the same addresses.
+	addrs = sortedStrings(addrs)
+
+	offsets := make([]uint64, len(addrs))
+	skips := make([]uint64, len(addrs))
+	next := make([]uint64, len(addrs))
+	m := uint64(size)
+
+	for i, addr := range addrs {
+		offsets[i] = hashString(addr) % m
+		skips[i] = hashString(addr+"#skip")%(m-1) + 1
+	}
+
+	table := make([]int32, size)
+	for i := range table {
+		table[i] = -1
+	}
+
+	for filled := 0; ; {
+		for i := range addrs {
+			c := (offsets[i] + next[i]*skips[i]) % m
+			for table[c] >= 0 {
+				next[i]++
+				c = (offsets[i] + next[i]*skips[i]) % m
+			}
+			table[c] = int32(i)
+			next[i]++
+
+			if filled++; filled == size {
+				return &maglevPicker{addrs: addrs, table: table}
+			}
+		}
+	}
+}
+
+type maglevPicker struct {
+	addrs []string
+	table []int32
+}
+
+func (p *maglevPicker) Pick(ctx context.Context) string {
+	key, ok := ShardKey(ctx)
+	if !ok {
+		return p.addrs[rand.Intn(len(p.addrs))]
+	}
+	return p.addrs[p.table[hashString(key)%uint64(len(p.table))]]
+}
+
+// JumpHash is a consistent hashing Balancer using the jump consistent hash
+// algorithm: https://arxiv.org/abs/1406.2294
+//
+// The balancer uses no memory besides the list of addresses and picks addresses
+// in time logarithmic to their number. However, keys are mapped to positions
+// in the sorted list of addresses, so it only minimizes the keys moved when
+// addresses are added or removed at the end of the list. It is best suited to
+// services with numbered instances whose names sort in order of creation.
+//
+// Calls to Resolve with a context that does not carry a shard key return
+// addresses picked at random.
+type JumpHash struct{}
+
+// NewPicker satisfies the Balancer interface.
+func (JumpHash) NewPicker(name string, addrs []string, prev Picker) Picker {
+	return jumpHashPicker(sortedStrings(addrs))
+}
+
+type jumpHashPicker []string
+
+func (p jumpHashPicker) Pick(ctx context.Context) string {
+	key, ok := ShardKey(ctx)
+	if !ok {
+		return p[rand.Intn(len(p))]
+	}
+	return p[jumpHash(hashString(key), len(p))]
+}
+
+func jumpHash(key uint64, n int) int {
+	b, j := int64(-1), int64(0)
+	for j < int64(n) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func nextPrime(n int) int {
+	if n <= 2 {
+		return 2
+	}
+	if n%2 == 0 {
+		n++
+	}
+	for !isPrime(n) {
+		n += 2
+	}
+	return n
+}
+
+func isPrime(n int) bool {
+	for i := 3; i*i <= n; i += 2 {
+		if n%i == 0 {
+			return false
+		}
+	}
+	return n%2 != 0
+}
+
+// hashString returns a 64 bits hash of s, computed with FNV-1a and mixed to
+// improve the distribution of the high bits.
+func hashString(s string) uint64 {
+	return mix64(fnv1a(fnvOffset64, s))
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// fnv1a adds the bytes of s to h, the FNV-1a hash of the data hashed so far
+// (fnvOffset64 initially).
+func fnv1a(h uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		h = (h ^ uint64(s[i])) * fnvPrime64
+	}
+	return h
+}
+
+// mix64 is the finalizer of MurmurHash3, it ensures that each bit of the input
+// affects all bits of the output.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"testing"
+)
+
+var consistentHashBalancers = []struct {
+	name     string
+	balancer Balancer
+	minimal  bool // only the keys of removed addresses move
+}{
+	{"ring hash", RingHash{}, true},
+	{"rendezvous", Rendezvous{}, true},
+	{"maglev", Maglev{}, false},
+	{"jump hash", JumpHash{}, false},
+}
+
+func TestConsistentHash(t *testing.T) {
+	for _, b := range consistentHashBalancers {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			t.Run("resolver", func(t *testing.T) {
+				testResolver(t, func(services map[string][]string) (Resolver, func()) {
+					cache := &Cache{Registry: registry(services), Balancer: b.balancer}
+					return cache, func() { cache.Close() }
+				})
+			})
+
+			t.Run("the same key always resolves to the same address", func(t *testing.T) {
+				cache := &Cache{
+					Registry: registry{"my-service": testAddrs(10)},
+					Balancer: b.balancer,
+				}
+				defer cache.Close()
+
+				ctx := context.Background()
+				addr, err := ResolveKey(ctx, cache, "my-service", "key-1")
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for i := 0; i != 10; i++ {
+					if a, _ := cache.Resolve(WithShardKey(ctx, "key-1"), "my-service"); a != addr {
+						t.Fatalf("key resolved to %s instead of %s", a, addr)
+					}
+				}
+			})
+
+			t.Run("the order of addresses does not matter", func(t *testing.T) {
+				addrs := testAddrs(10)
+				p1 := b.balancer.NewPicker("my-service", addrs, nil)
+				p2 := b.balancer.NewPicker("my-service", shuffledStrings(addrs), nil)
+
+				for i := 0; i != 1000; i++ {
+					ctx := WithShardKey(context.Background(), "key-"+strconv.Itoa(i))
+					if a, b := p1.Pick(ctx), p2.Pick(ctx); a != b {
+						t.Fatalf("key-%d resolved to %s and %s", i, a, b)
+					}
+				}
+			})
+
+			t.Run("keys are spread evenly across addresses", func(t *testing.T) {
+				const keys = 10000
+				addrs := testAddrs(10)
+				counts := countKeys(b.balancer.NewPicker("my-service", addrs, nil), keys)
+
+				for _, addr := range addrs {
+					if r := float64(counts[addr]) / keys; math.Abs(r-0.1) > 0.05 {
+						t.Errorf("%s was picked for %.1f%% of the keys", addr, 100*r)
+					}
+				}
+			})
+
+			if !b.minimal {
+				return
+			}
+
+			t.Run("removing an address only moves the keys it owned", func(t *testing.T) {
+				addrs := testAddrs(10)
+				before := b.balancer.NewPicker("my-service", addrs, nil)
+				after := b.balancer.NewPicker("my-service", addrs[1:], before)
+
+				for i := 0; i != 10000; i++ {
+					ctx := WithShardKey(context.Background(), "key-"+strconv.Itoa(i))
+					a, b := before.Pick(ctx), after.Pick(ctx)
+
+					if a != addrs[0] && a != b {
+						t.Fatalf("key-%d moved from %s to %s", i, a, b)
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestConsistentHashDisruption reports the fraction of keys moved to different
+// addresses when the membership of a service changes, run with -v to see the
+// report. The ideal fraction when one of n addresses is added or removed is
+// 1/n.
+func TestConsistentHashDisruption(t *testing.T) {
+	const keys = 20000
+
+	changes := []struct {
+		name   string
+		change func([]string) []string
+	}{
+		{"remove first", func(addrs []string) []string { return addrs[1:] }},
+		{"remove last", func(addrs []string) []string { return addrs[:len(addrs)-1] }},
+		{"add last", func(addrs []string) []string { return testAddrs(len(addrs) + 1) }},
+	}
+
+	t.Logf("%-12s %6s %-14s %8s %8s", "balancer", "addrs", "change", "moved", "ideal")
+
+	for _, b := range consistentHashBalancers {
+		for _, n := range []int{10, 100, 1000} {
+			addrs := testAddrs(n)
+			before := b.balancer.NewPicker("my-service", addrs, nil)
+
+			for _, c := range changes {
+				after := b.balancer.NewPicker("my-service", c.change(addrs), before)
+				moved := float64(movedKeys(before, after, keys)) / keys
+				ideal := 1 / float64(n)
+
+				t.Logf("%-12s %6d %-14s %7.2f%% %7.2f%%", b.name, n, c.name, 100*moved, 100*ideal)
+
+				if c.name != "remove first" || b.minimal {
+					if moved > 2*ideal+0.01 {
+						t.Errorf("%s: %s of %d addresses moved %.2f%% of the keys", b.name, c.name, n, 100*moved)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestShardKey(t *testing.T) {
+	if _, ok := ShardKey(context.Background()); ok {
+		t.Error("found a shard key in a context without one")
+	}
+
+	if key, ok := ShardKey(WithShardKey(context.Background(), "A")); !ok || key != "A" {
+		t.Errorf("bad shard key: %q %t", key, ok)
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	// Reference values from the paper's implementation.
+	tests := []struct {
+		key     uint64
+		buckets int
+		bucket  int
+	}{
+		{key: 1, buckets: 1, bucket: 0},
+		{key: 0xDEAD10CC, buckets: 1, bucket: 0},
+		{key: 0xDEAD10CC, buckets: 666, bucket: 361},
+		{key: 256, buckets: 1024, bucket: 520},
+	}
+
+	for _, test := range tests {
+		if bucket := jumpHash(test.key, test.buckets); bucket != test.bucket {
+			t.Errorf("jumpHash(%d, %d) = %d, want %d", test.key, test.buckets, bucket, test.bucket)
+		}
+	}
+}
+
+func BenchmarkConsistentHash(b *testing.B) {
+	for _, h := range consistentHashBalancers {
+		for _, n := range []int{10, 100, 1000, 5000} {
+			addrs := testAddrs(n)
+
+			b.Run(fmt.Sprintf("%s/%d/pick", h.name, n), func(b *testing.B) {
+				picker := h.balancer.NewPicker("my-service", addrs, nil)
+				ctx := WithShardKey(context.Background(), "key")
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					picker.Pick(ctx)
+				}
+			})
+
+			b.Run(fmt.Sprintf("%s/%d/build", h.name, n), func(b *testing.B) {
+				b.ReportAllocs()
+
+				for i := 0; i < b.N; i++ {
+					h.balancer.NewPicker("my-service", addrs, nil)
+				}
+			})
+		}
+	}
+}
+
+// testAddrs returns a list of n addresses, sorted in lexicographic order.
+func testAddrs(n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("host-%05d:4242", i)
+	}
+	return addrs
+}
+
+func countKeys(picker Picker, keys int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i != keys; i++ {
+		counts[picker.Pick(WithShardKey(context.Background(), "key-"+strconv.Itoa(i)))]++
+	}
+	return counts
+}
+
+func movedKeys(before, after Picker, keys int) int {
+	moved := 0
+	for i := 0; i != keys; i++ {
+		ctx := WithShardKey(context.Background(), "key-"+strconv.Itoa(i))
+		if before.Pick(ctx) != after.Pick(ctx) {
+			moved++
+		}
+	}
+	return moved
+}
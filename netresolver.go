@@ -0,0 +1,230 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NewNetResolver returns a standard resolver which answers DNS queries from the
+// given registry.
+//
+// The returned resolver never sends queries over the network, instead it
+// synthesizes DNS responses in-process from the results returned by the
+// registry's Lookup method. This makes it possible to inject registries (like
+// Cache or the ones returned by Prefer) into code that only accepts values of
+// type *net.Resolver.
+//
+// SRV queries are answered with one record per address returned by the
+// registry. When an address is an IP rather than a host name the SRV target is
+// set to a synthetic host name which the resolver knows how to translate back
+// to the IP.
+//
+// A and AAAA queries are answered with the addresses returned by the registry
+// which are IPs, host names are only exposed through SRV records.
+//
+// Note that the standard resolver may apply search domains configured on the
+// system before querying the name that was passed to its methods, the registry
+// will see those names as well.
+func NewNetResolver(r Registry) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return &netResolverConn{ctx: ctx, registry: r}, nil
+		},
+	}
+}
+
+// netResolverDomain is the domain under which synthetic host names are created
+// for IP addresses found in SRV records.
+const netResolverDomain = "ip.services.internal."
+
+func netResolverTarget(host string) string {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return dns.Fqdn(host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return hex.EncodeToString(ip) + "." + netResolverDomain
+}
+
+func netResolverTargetIP(name string) (net.IP, bool) {
+	if !strings.HasSuffix(name, "."+netResolverDomain) {
+		return nil, false
+	}
+	b, err := hex.DecodeString(strings.TrimSuffix(name, "."+netResolverDomain))
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil, false
+	}
+	return net.IP(b), true
+}
+
+// netResolverConn is an in-memory implementation of net.Conn which speaks the
+// DNS over TCP protocol. It does not implement net.PacketConn so the standard
+// resolver uses the stream framing (messages prefixed with their length).
+type netResolverConn struct {
+	ctx      context.Context
+	registry Registry
+
+	mutex sync.Mutex
+	rbuf  bytes.Buffer
+	wbuf  bytes.Buffer
+}
+
+func (c *netResolverConn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.rbuf.Len() == 0 {
+		return 0, io.EOF
+	}
+
+	return c.rbuf.Read(b)
+}
+
+func (c *netResolverConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.wbuf.Write(b)
+
+	for c.wbuf.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.wbuf.Bytes()))
+		if c.wbuf.Len() < 2+size {
+			break
+		}
+
+		c.wbuf.Next(2)
+		req := &dns.Msg{}
+
+		if err := req.Unpack(c.wbuf.Next(size)); err != nil {
+			return 0, err
+		}
+
+		res, err := c.serve(req).Pack()
+		if err != nil {
+			return 0, err
+		}
+
+		var prefix [2]byte
+		binary.BigEndian.PutUint16(prefix[:], uint16(len(res)))
+		c.rbuf.Write(prefix[:])
+		c.rbuf.Write(res)
+	}
+
+	return len(b), nil
+}
+
+func (c *netResolverConn) serve(req *dns.Msg) *dns.Msg {
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Authoritative = true
+	res.RecursionAvailable = true
+
+	if len(req.Question) != 1 {
+		res.Rcode = dns.RcodeFormatError
+		return res
+	}
+
+	question := req.Question[0]
+	header := dns.RR_Header{
+		Name:  question.Name,
+		Class: dns.ClassINET,
+	}
+
+	if ip, ok := netResolverTargetIP(question.Name); ok {
+		if rr := netResolverIP(header, question.Qtype, ip); rr != nil {
+			res.Answer = append(res.Answer, rr)
+		}
+		return res
+	}
+
+	addrs, ttl, err := c.registry.Lookup(c.ctx, strings.TrimSuffix(question.Name, "."))
+	switch {
+	case err == nil && len(addrs) != 0:
+	case err == nil, isUnreachable(err):
+		res.Rcode = dns.RcodeNameError
+		return res
+	default:
+		res.Rcode = dns.RcodeServerFailure
+		return res
+	}
+
+	header.Ttl = uint32(ttl / time.Second)
+
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+
+		switch question.Qtype {
+		case dns.TypeSRV:
+			portNumber, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				continue
+			}
+			hdr := header
+			hdr.Rrtype = dns.TypeSRV
+			res.Answer = append(res.Answer, &dns.SRV{
+				Hdr:      hdr,
+				Priority: 1,
+				Weight:   1,
+				Port:     uint16(portNumber),
+				Target:   netResolverTarget(host),
+			})
+
+		case dns.TypeA, dns.TypeAAAA:
+			if ip := net.ParseIP(host); ip != nil {
+				if rr := netResolverIP(header, question.Qtype, ip); rr != nil {
+					res.Answer = append(res.Answer, rr)
+				}
+			}
+		}
+	}
+
+	return res
+}
+
+func netResolverIP(header dns.RR_Header, qtype uint16, ip net.IP) dns.RR {
+	ip4 := ip.To4()
+	header.Rrtype = qtype
+
+	switch {
+	case qtype == dns.TypeA && ip4 != nil:
+		return &dns.A{Hdr: header, A: ip4}
+	case qtype == dns.TypeAAAA && ip4 == nil:
+		return &dns.AAAA{Hdr: header, AAAA: ip}
+	}
+
+	return nil
+}
+
+func (c *netResolverConn) Close() error { return nil }
+
+func (c *netResolverConn) LocalAddr() net.Addr { return netResolverAddr{} }
+
+func (c *netResolverConn) RemoteAddr() net.Addr { return netResolverAddr{} }
+
+func (c *netResolverConn) SetDeadline(t time.Time) error { return nil }
+
+func (c *netResolverConn) SetReadDeadline(t time.Time) error { return nil }
+
+func (c *netResolverConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type netResolverAddr struct{}
+
+func (netResolverAddr) Network() string { return "services" }
+
+func (netResolverAddr) String() string { return "registry" }
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestNetResolver(t *testing.T) {
+	tests := []struct {
+		scenario string
+		function func(*testing.T, *net.Resolver)
+	}{
+		{
+			scenario: "looking up SRV records returns the addresses of the service",
+			function: testNetResolverLookupSRV,
+		},
+
+		{
+			scenario: "looking up the target of SRV records for IP addresses returns the IPs",
+			function: testNetResolverLookupSRVTarget,
+		},
+
+		{
+			scenario: "looking up the host of a service returns the IP addresses of the service",
+			function: testNetResolverLookupHost,
+		},
+
+		{
+			scenario: "looking up an unknown service returns a not found error",
+			function: testNetResolverNotFound,
+		},
+
+		{
+			scenario: "using the standard resolver with NewResolver returns one of the service addresses",
+			function: testNetResolverNewResolver,
+		},
+	}
+
+	r := NewNetResolver(registry{
+		"service-1": {
+			"localhost:4000",
+			"localhost:4001",
+		},
+		"service-2": {
+			"127.0.0.1:4002",
+			"[::1]:4003",
+		},
+	})
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) { test.function(t, r) })
+	}
+}
+
+func testNetResolverLookupSRV(t *testing.T, r *net.Resolver) {
+	_, srvs, err := r.LookupSRV(context.Background(), "", "", "service-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports := []int{}
+	for _, srv := range srvs {
+		if srv.Target != "localhost." {
+			t.Error("bad SRV target:", srv.Target)
+		}
+		ports = append(ports, int(srv.Port))
+	}
+	sort.Ints(ports)
+
+	if !reflect.DeepEqual(ports, []int{4000, 4001}) {
+		t.Error("bad SRV ports:", ports)
+	}
+}
+
+func testNetResolverLookupSRVTarget(t *testing.T, r *net.Resolver) {
+	_, srvs, err := r.LookupSRV(context.Background(), "", "", "service-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addrs := []string{}
+	for _, srv := range srvs {
+		hosts, err := r.LookupHost(context.Background(), srv.Target)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+		}
+	}
+	sort.Strings(addrs)
+
+	if !reflect.DeepEqual(addrs, []string{"127.0.0.1:4002", "[::1]:4003"}) {
+		t.Error("bad addresses:", addrs)
+	}
+}
+
+func testNetResolverLookupHost(t *testing.T, r *net.Resolver) {
+	hosts, err := r.LookupHost(context.Background(), "service-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(hosts)
+
+	if !reflect.DeepEqual(hosts, []string{"127.0.0.1", "::1"}) {
+		t.Error("bad hosts:", hosts)
+	}
+}
+
+func testNetResolverNotFound(t *testing.T, r *net.Resolver) {
+	_, err := r.LookupHost(context.Background(), "whatever")
+
+	if e, ok := err.(*net.DNSError); !ok || !e.IsNotFound {
+		t.Errorf("expected a not found error but got %#v (%s)", err, err)
+	}
+
+	if !isUnreachable(err) {
+		t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+	}
+}
+
+func testNetResolverNewResolver(t *testing.T, r *net.Resolver) {
+	addr, err := NewResolver(r).Resolve(context.Background(), "service-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr != "localhost:4000" && addr != "localhost:4001" {
+		t.Error("bad address:", addr)
+	}
+}
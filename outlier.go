@@ -0,0 +1,324 @@
+package services
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheOutliers holds the state of outlier detection for the addresses of a
+// service.
+//
+// The number of ejected addresses, the expiration and the version are loaded
+// atomically by Resolve, they are only modified while holding the mutex.
+//
+// Addresses which are not ejected are removed when they leave the service, and
+// the state of the service is removed when it holds no addresses anymore.
+type cacheOutliers struct {
+	ejected int64  // number of addresses currently ejected
+	expires int64  // earliest expiration of the current ejections (unix nanoseconds)
+	version uint64 // incremented when the set of ejected addresses changes
+	mutex   sync.Mutex
+	addrs   map[string]*cacheOutlier
+	removed bool // true once removed from the cache
+}
+
+type cacheOutlier struct {
+	failures  int       // consecutive connection failures
+	ejections int       // ejections since the last successful connection
+	until     time.Time // end of the current ejection, zero if not ejected
+}
+
+// observeOutlier records the outcome of a connection to addr, ejecting it when
+// the number of consecutive failures reaches the configured threshold.
+func (c *Cache) observeOutlier(name string, addr string, err error) {
+	for {
+		o := c.outliersOf(name, err != nil)
+		if o == nil || c.observeOutlierOf(o, name, addr, err) {
+			return
+		}
+	}
+}
+
+// observeOutlierOf is like observeOutlier for o, the outlier detection state
+// of the service. The method returns false if o was removed concurrently.
+func (c *Cache) observeOutlierOf(o *cacheOutliers, name string, addr string, err error) bool {
+	now := time.Now()
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if o.removed {
+		return false
+	}
+
+	c.reinstate(o, now)
+	s := o.addrs[addr]
+
+	if err == nil {
+		if s != nil && s.until.IsZero() {
+			delete(o.addrs, addr)
+			c.removeOutliers(o, name)
+		}
+		return true
+	}
+
+	addrs, cached := c.addrsOf(name)
+
+	if s == nil {
+		if cached {
+			c.prune(o, addrs)
+		}
+		s = &cacheOutlier{}
+		o.addrs[addr] = s
+	}
+
+	// Failures of connections made before the address was ejected are not
+	// counted, it could otherwise be ejected again as soon as reinstated.
+	if !s.until.IsZero() {
+		return true
+	}
+
+	if s.failures++; s.failures < c.EjectionFailures {
+		return true
+	}
+
+	total := len(addrs)
+	if total == 0 || (o.ejected+1)*100 > int64(total*c.maxEjectionPercent()) {
+		return true
+	}
+
+	s.failures = 0
+	s.ejections++
+	s.until = now.Add(c.ejectionTime(s.ejections))
+
+	if o.ejected == 0 || s.until.UnixNano() < o.expires {
+		atomic.StoreInt64(&o.expires, s.until.UnixNano())
+	}
+	atomic.AddInt64(&o.ejected, +1)
+	atomic.AddUint64(&o.version, +1)
+
+	atomic.AddInt64(&c.ejections, +1)
+	atomic.AddInt64(&c.ejected, +1)
+	return true
+}
+
+// pruneOutliers removes the outlier detection state of the addresses which do
+// not belong to the service anymore, when item holds the addresses of the
+// service without tags. Ejected addresses are kept until they are reinstated.
+func (c *Cache) pruneOutliers(item *cacheItem) {
+	if c.EjectionFailures <= 0 || item.key.tags != "" || (item.err != nil && !isUnreachable(item.err)) {
+		return
+	}
+
+	o := c.outliersOf(item.key.name, false)
+	if o == nil {
+		return
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if !o.removed {
+		c.prune(o, item.addrs)
+		c.removeOutliers(o, item.key.name)
+	}
+}
+
+// prune removes the addresses of o which are not ejected and not in addrs. The
+// mutex of o must be held.
+func (c *Cache) prune(o *cacheOutliers, addrs []string) {
+	set := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		set[addr] = struct{}{}
+	}
+
+	for addr, s := range o.addrs {
+		if _, ok := set[addr]; !ok && s.until.IsZero() {
+			delete(o.addrs, addr)
+		}
+	}
+}
+
+// removeOutliers removes o, the outlier detection state of the service with the
+// given name, from the cache if it holds no addresses. The mutex of o must be
+// held.
+func (c *Cache) removeOutliers(o *cacheOutliers, name string) {
+	if len(o.addrs) == 0 {
+		o.removed = true
+		c.outliers.Delete(name)
+	}
+}
+
+// reinstate puts back in rotation the addresses of o which reached the end of
+// their ejection. The mutex of o must be held.
+func (c *Cache) reinstate(o *cacheOutliers, now time.Time) {
+	if o.ejected == 0 || now.UnixNano() < o.expires {
+		return
+	}
+
+	ejected, expires := int64(0), int64(0)
+
+	for _, s := range o.addrs {
+		switch {
+		case s.until.IsZero():
+		case !now.Before(s.until):
+			s.until = time.Time{}
+			atomic.AddInt64(&c.ejected, -1)
+		default:
+			if ejected == 0 || s.until.UnixNano() < expires {
+				expires = s.until.UnixNano()
+			}
+			ejected++
+		}
+	}
+
+	atomic.StoreInt64(&o.ejected, ejected)
+	atomic.StoreInt64(&o.expires, expires)
+	atomic.AddUint64(&o.version, +1)
+}
+
+// picker returns the picker that Resolve uses for item, which excludes the
+// addresses ejected by outlier detection.
+//
+// No locks are taken unless ejections expired, or the picker of item must be
+// rebuilt because the set of ejected addresses changed.
+func (c *Cache) picker(item *cacheItem) Picker {
+	if c.EjectionFailures <= 0 {
+		return item.picker
+	}
+
+	o := c.outliersOf(item.key.name, false)
+	if o == nil || atomic.LoadInt64(&o.ejected) == 0 {
+		return item.picker
+	}
+
+	if now := time.Now(); now.UnixNano() >= atomic.LoadInt64(&o.expires) {
+		o.mutex.Lock()
+		c.reinstate(o, now)
+		o.mutex.Unlock()
+
+		if atomic.LoadInt64(&o.ejected) == 0 {
+			return item.picker
+		}
+	}
+
+	version := atomic.LoadUint64(&o.version)
+	if h, _ := item.healthy.Load().(*cacheHealthy); h != nil && h.outliers == o && h.version == version {
+		return h.picker
+	}
+
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if h, _ := item.healthy.Load().(*cacheHealthy); h != nil && h.outliers == o && h.version == o.version {
+		return h.picker
+	}
+
+	healthy := make([]string, 0, len(item.addrs))
+
+	for _, addr := range item.addrs {
+		if s := o.addrs[addr]; s == nil || s.until.IsZero() {
+			healthy = append(healthy, addr)
+		}
+	}
+
+	h := &cacheHealthy{outliers: o, version: o.version, picker: item.picker}
+
+	if len(healthy) != 0 && len(healthy) != len(item.addrs) {
+		h.picker = newPicker(c.Balancer, item.key.name, healthy, item.weights, item.picker)
+	}
+
+	item.healthyMutex.Lock()
+	prev, _ := item.healthy.Load().(*cacheHealthy)
+	released := item.released
+	if !released {
+		item.healthy.Store(h)
+	}
+	item.healthyMutex.Unlock()
+
+	if released {
+		// The item was evicted, the picker is only used by this call.
+		if h.picker != item.picker {
+			releasePicker(h.picker)
+		}
+		return h.picker
+	}
+
+	if prev != nil && prev.picker != item.picker {
+		releasePicker(prev.picker)
+	}
+
+	return h.picker
+}
+
+// cacheHealthy is the picker of the addresses of a cache item which were not
+// ejected, for a version of the ejections of the service.
+type cacheHealthy struct {
+	outliers *cacheOutliers
+	version  uint64
+	picker   Picker
+}
+
+// outliersOf returns the outlier detection state of the service with the given
+// name, creating it if it does not exist and create is true.
+func (c *Cache) outliersOf(name string, create bool) *cacheOutliers {
+	if o, ok := c.outliers.Load(name); ok {
+		return o.(*cacheOutliers)
+	}
+	if !create {
+		return nil
+	}
+	o, _ := c.outliers.LoadOrStore(name, &cacheOutliers{addrs: make(map[string]*cacheOutlier)})
+	return o.(*cacheOutliers)
+}
+
+// addrsOf returns the addresses of the service with the given name in the
+// cache, without looking it up if it is not cached. The method returns false if
+// the service is not cached.
+func (c *Cache) addrsOf(name string) ([]string, bool) {
+	c.init()
+	key := makeCacheKey(name, nil)
+	hash := key.hash()
+	shard := c.shard(hash)
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if elem, ok := shard.items[key]; ok {
+		if item := elem.Value.(*cacheItem); item.isReady() && item.err == nil {
+			return item.addrs, true
+		}
+	}
+
+	return nil, false
+}
+
+func (c *Cache) ejectionTime(ejections int) time.Duration {
+	t := c.EjectionTime
+	if t <= 0 {
+		t = 30 * time.Second
+	}
+
+	maxTime := c.MaxEjectionTime
+	if maxTime <= 0 {
+		maxTime = 5 * time.Minute
+	}
+
+	for i := 1; i < ejections && t < maxTime; i++ {
+		t *= 2
+	}
+
+	if t > maxTime {
+		t = maxTime
+	}
+
+	return t
+}
+
+func (c *Cache) maxEjectionPercent() int {
+	if p := c.MaxEjectionPercent; p > 0 && p <= 100 {
+		return p
+	}
+	return 50
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheOutliers(t *testing.T) {
+	failed := errors.New("connection refused")
+	addrs := []string{"localhost:4000", "localhost:4001", "localhost:4002", "localhost:4003"}
+
+	newCache := func() *Cache {
+		cache := &Cache{
+			Registry:         registry{"my-service": addrs},
+			EjectionFailures: 2,
+			EjectionTime:     50 * time.Millisecond,
+		}
+		// Populate the cache so the number of addresses is known.
+		if _, err := cache.Resolve(context.Background(), "my-service"); err != nil {
+			t.Fatal(err)
+		}
+		return cache
+	}
+
+	resolveAll := func(cache *Cache) map[string]int {
+		counts := make(map[string]int)
+		for i := 0; i != 100; i++ {
+			addr, err := cache.Resolve(context.Background(), "my-service")
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[addr]++
+		}
+		return counts
+	}
+
+	t.Run("addresses are ejected after consecutive failures and reinstated later", func(t *testing.T) {
+		cache := newCache()
+		defer cache.Close()
+
+		cache.ObserveDial("my-service", "localhost:4000", 0, failed)
+		if stats := cache.Stats(); stats.Ejections != 0 {
+			t.Error("address ejected after a single failure")
+		}
+
+		cache.ObserveDial("my-service", "localhost:4000", 0, failed)
+		if stats := cache.Stats(); stats.Ejections != 1 || stats.Ejected != 1 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+
+		if counts := resolveAll(cache); counts["localhost:4000"] != 0 || len(counts) != 3 {
+			t.Error("bad distribution of addresses with one ejected:", counts)
+		}
+
+		time.Sleep(60 * time.Millisecond)
+
+		if counts := resolveAll(cache); counts["localhost:4000"] == 0 {
+			t.Error("the address was not reinstated:", counts)
+		}
+
+		if stats := cache.Stats(); stats.Ejected != 0 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+	})
+
+	t.Run("successful connections reset the count of consecutive failures", func(t *testing.T) {
+		cache := newCache()
+		defer cache.Close()
+
+		cache.ObserveDial("my-service", "localhost:4000", 0, failed)
+		cache.ObserveDial("my-service", "localhost:4000", 0, nil)
+		cache.ObserveDial("my-service", "localhost:4000", 0, failed)
+
+		if stats := cache.Stats(); stats.Ejections != 0 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+	})
+
+	t.Run("no more than the maximum percentage of addresses are ejected", func(t *testing.T) {
+		cache := newCache()
+		defer cache.Close()
+
+		for _, addr := range addrs {
+			cache.ObserveDial("my-service", addr, 0, failed)
+			cache.ObserveDial("my-service", addr, 0, failed)
+		}
+
+		if stats := cache.Stats(); stats.Ejections != 2 || stats.Ejected != 2 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+
+		if counts := resolveAll(cache); len(counts) != 2 {
+			t.Error("bad distribution of addresses with half of them ejected:", counts)
+		}
+	})
+
+	t.Run("the state of addresses which left the service is removed", func(t *testing.T) {
+		cache := newCache()
+		defer cache.Close()
+
+		for i := 0; i != 1000; i++ {
+			cache.ObserveDial("my-service", "localhost:"+strconv.Itoa(5000+i), 0, failed)
+		}
+
+		o := cache.outliersOf("my-service", false)
+		o.mutex.Lock()
+		n := len(o.addrs)
+		o.mutex.Unlock()
+
+		if n != 1 {
+			t.Errorf("the state of %d addresses is retained", n)
+		}
+
+		cache.ObserveDial("my-service", "localhost:5999", 0, nil)
+
+		if cache.outliersOf("my-service", false) != nil {
+			t.Error("the state of the service was retained after all its addresses were removed")
+		}
+	})
+
+	t.Run("the ejection time grows exponentially", func(t *testing.T) {
+		cache := &Cache{EjectionTime: time.Second, MaxEjectionTime: 5 * time.Second}
+
+		for i, ejectionTime := range []time.Duration{1 * time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second} {
+			if t2 := cache.ejectionTime(i + 1); t2 != ejectionTime {
+				t.Errorf("ejection #%d: %s != %s", i+1, t2, ejectionTime)
+			}
+		}
+	})
+
+	t.Run("addresses that fail to accept connections from the dialer are ejected", func(t *testing.T) {
+		live, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer live.Close()
+
+		dead, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dead.Close()
+
+		cache := &Cache{
+			Registry:         registry{"my-service": {live.Addr().String(), dead.Addr().String()}},
+			EjectionFailures: 1,
+		}
+		defer cache.Close()
+
+		d := &Dialer{Resolver: cache}
+		errs := 0
+
+		for i := 0; i != 10; i++ {
+			c, err := d.Dial("tcp", "my-service:0")
+			if err != nil {
+				errs++
+				continue
+			}
+			c.Close()
+		}
+
+		if errs > 1 {
+			t.Errorf("%d dials failed after the dead address should have been ejected", errs)
+		}
+
+		if stats := cache.Stats(); stats.Ejections != int64(errs) {
+			t.Errorf("bad stats: %+v", stats)
+		}
+	})
+}
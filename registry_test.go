@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -86,6 +87,7 @@ func (f registryFunc) Lookup(ctx context.Context, name string, tags ...string) (
 
 type lookupRecorder struct {
 	registry Registry
+	mutex    sync.Mutex
 	lookups  []lookup
 }
 
@@ -112,7 +114,9 @@ func (r *lookupRecorder) Lookup(ctx context.Context, name string, tags ...string
 	lookup.ttl = ttl
 	lookup.err = err
 
+	r.mutex.Lock()
 	r.lookups = append(r.lookups, lookup)
+	r.mutex.Unlock()
 	return addrs, ttl, err
 }
 
@@ -0,0 +1,201 @@
+package services
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// ShadowRegistry is an implementation of the Registry interface which serves
+// results from a primary registry while comparing them with the results of a
+// shadow registry.
+//
+// This is useful when migrating from one service discovery system to another,
+// to gain confidence that the new backend agrees with the old one before
+// switching over.
+//
+// Lookups on the shadow registry are made asynchronously after the primary
+// registry returned, so they do not add latency to the calls to Lookup. When
+// too many of them are in flight, comparisons are dropped so a slow shadow
+// registry does not accumulate goroutines.
+type ShadowRegistry struct {
+	// The registry that results are served from. This field must not be nil.
+	Primary Registry
+
+	// The registry that results are compared with. This field must not be nil.
+	Shadow Registry
+
+	// Timeout of lookups on the shadow registry. Defaults to 10 seconds.
+	Timeout time.Duration
+
+	// Maximum number of concurrent lookups on the shadow registry, comparisons
+	// exceeding the limit are dropped. Defaults to 100.
+	MaxConcurrentLookups int
+
+	// Maximum difference between the TTLs returned by the primary and shadow
+	// registries for them to be considered matching.
+	TTLTolerance time.Duration
+
+	// Report is called, if not nil, when the results of the primary and shadow
+	// registries diverge. The function is called from a different goroutine
+	// than the one that called Lookup.
+	Report func(ShadowDivergence)
+
+	// number of lookups in flight on the shadow registry
+	inflight int64
+
+	// stats
+	lookups         int64
+	drops           int64
+	matches         int64
+	addrMismatches  int64
+	ttlMismatches   int64
+	errorMismatches int64
+}
+
+// ShadowDivergence carries the details of a divergence between the results of
+// the primary and shadow registries of a ShadowRegistry.
+type ShadowDivergence struct {
+	Name string
+	Tags []string
+
+	// Addresses returned by the shadow registry but not the primary.
+	Added []string
+
+	// Addresses returned by the primary registry but not the shadow.
+	Missing []string
+
+	PrimaryTTL time.Duration
+	ShadowTTL  time.Duration
+
+	PrimaryErr error
+	ShadowErr  error
+}
+
+// ShadowStats exposes internal statistics on the comparisons made by a shadow
+// registry. Drops counts the comparisons skipped because the maximum number of
+// concurrent lookups on the shadow registry was reached.
+type ShadowStats struct {
+	Lookups         int64 `metric:"services.shadow.lookups"          type:"counter"`
+	Drops           int64 `metric:"services.shadow.drops"            type:"counter"`
+	Matches         int64 `metric:"services.shadow.matches"          type:"counter"`
+	AddrMismatches  int64 `metric:"services.shadow.addr_mismatches"  type:"counter"`
+	TTLMismatches   int64 `metric:"services.shadow.ttl_mismatches"   type:"counter"`
+	ErrorMismatches int64 `metric:"services.shadow.error_mismatches" type:"counter"`
+}
+
+// Stats takes a snapshot of the current comparison statistics of the shadow
+// registry.
+//
+// Because comparisons happen asynchronously, the snapshot may not reflect the
+// result of the most recent lookups.
+func (s *ShadowRegistry) Stats() ShadowStats {
+	return ShadowStats{
+		Lookups:         atomic.LoadInt64(&s.lookups),
+		Drops:           atomic.LoadInt64(&s.drops),
+		Matches:         atomic.LoadInt64(&s.matches),
+		AddrMismatches:  atomic.LoadInt64(&s.addrMismatches),
+		TTLMismatches:   atomic.LoadInt64(&s.ttlMismatches),
+		ErrorMismatches: atomic.LoadInt64(&s.errorMismatches),
+	}
+}
+
+// Lookup satisfies the Registry interface.
+func (s *ShadowRegistry) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+	addrs, ttl, err := s.Primary.Lookup(ctx, name, tags...)
+
+	if isCanceled(err) {
+		return addrs, ttl, err
+	}
+
+	if atomic.AddInt64(&s.inflight, +1) > int64(s.maxConcurrentLookups()) {
+		atomic.AddInt64(&s.inflight, -1)
+		atomic.AddInt64(&s.drops, +1)
+	} else {
+		go s.compare(ShadowDivergence{
+			Name:       name,
+			Tags:       copyStrings(tags),
+			PrimaryTTL: ttl,
+			PrimaryErr: err,
+		}, copyStrings(addrs))
+	}
+
+	return addrs, ttl, err
+}
+
+func (s *ShadowRegistry) compare(d ShadowDivergence, primaryAddrs []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout())
+	defer cancel()
+	defer atomic.AddInt64(&s.lookups, +1)
+	defer atomic.AddInt64(&s.inflight, -1)
+
+	shadowAddrs, shadowTTL, shadowErr := s.Shadow.Lookup(ctx, d.Name, d.Tags...)
+	d.ShadowTTL, d.ShadowErr = shadowTTL, shadowErr
+
+	if (d.PrimaryErr == nil) != (d.ShadowErr == nil) {
+		atomic.AddInt64(&s.errorMismatches, +1)
+		s.report(d)
+		return
+	}
+
+	if d.PrimaryErr != nil {
+		atomic.AddInt64(&s.matches, +1)
+		return
+	}
+
+	d.Added = diffStrings(shadowAddrs, primaryAddrs)
+	d.Missing = diffStrings(primaryAddrs, shadowAddrs)
+	diverged := false
+
+	if len(d.Added) != 0 || len(d.Missing) != 0 {
+		atomic.AddInt64(&s.addrMismatches, +1)
+		diverged = true
+	}
+
+	if diff := d.PrimaryTTL - d.ShadowTTL; diff > s.TTLTolerance || -diff > s.TTLTolerance {
+		atomic.AddInt64(&s.ttlMismatches, +1)
+		diverged = true
+	}
+
+	if diverged {
+		s.report(d)
+	} else {
+		atomic.AddInt64(&s.matches, +1)
+	}
+}
+
+func (s *ShadowRegistry) report(d ShadowDivergence) {
+	if s.Report != nil {
+		s.Report(d)
+	}
+}
+
+func (s *ShadowRegistry) timeout() time.Duration {
+	if timeout := s.Timeout; timeout > 0 {
+		return timeout
+	}
+	return 10 * time.Second
+}
+
+func (s *ShadowRegistry) maxConcurrentLookups() int {
+	if n := s.MaxConcurrentLookups; n > 0 {
+		return n
+	}
+	return 100
+}
+
+// diffStrings returns the list of strings in a that are not in b.
+func diffStrings(a, b []string) []string {
+	set := make(map[string]struct{}, len(b))
+	for _, s := range b {
+		set[s] = struct{}{}
+	}
+
+	var diff []string
+	for _, s := range a {
+		if _, ok := set[s]; !ok {
+			diff = append(diff, s)
+		}
+	}
+	return diff
+}
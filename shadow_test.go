@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestShadowRegistry(t *testing.T) {
+	t.Run("matching results are not reported", func(t *testing.T) {
+		reports := make(chan ShadowDivergence, 1)
+
+		s := &ShadowRegistry{
+			Primary: registry{"my-service": {"localhost:4000", "localhost:4001"}},
+			Shadow:  registry{"my-service": {"localhost:4001", "localhost:4000"}},
+			Report:  func(d ShadowDivergence) { reports <- d },
+		}
+
+		s.Lookup(context.Background(), "my-service")
+		waitShadowLookups(t, s, 1)
+
+		select {
+		case d := <-reports:
+			t.Errorf("unexpected divergence: %+v", d)
+		default:
+		}
+
+		if stats := s.Stats(); stats.Matches != 1 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+	})
+
+	t.Run("diverging addresses are reported", func(t *testing.T) {
+		reports := make(chan ShadowDivergence, 1)
+
+		s := &ShadowRegistry{
+			Primary: registry{"my-service": {"localhost:4000", "localhost:4001"}},
+			Shadow:  registry{"my-service": {"localhost:4001", "localhost:4002"}},
+			Report:  func(d ShadowDivergence) { reports <- d },
+		}
+
+		addrs, _, _ := s.Lookup(context.Background(), "my-service")
+
+		if !reflect.DeepEqual(addrs, []string{"localhost:4000", "localhost:4001"}) {
+			t.Error("addresses not served from the primary registry:", addrs)
+		}
+
+		d := <-reports
+
+		if !reflect.DeepEqual(d.Added, []string{"localhost:4002"}) {
+			t.Error("bad added addresses:", d.Added)
+		}
+
+		if !reflect.DeepEqual(d.Missing, []string{"localhost:4000"}) {
+			t.Error("bad missing addresses:", d.Missing)
+		}
+
+		if stats := s.Stats(); stats.AddrMismatches != 1 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+	})
+
+	t.Run("diverging errors are reported", func(t *testing.T) {
+		reports := make(chan ShadowDivergence, 1)
+
+		s := &ShadowRegistry{
+			Primary: registry{"my-service": {"localhost:4000"}},
+			Shadow:  registry{},
+			Report:  func(d ShadowDivergence) { reports <- d },
+		}
+
+		s.Lookup(context.Background(), "my-service")
+
+		if d := <-reports; !isUnreachable(d.ShadowErr) {
+			t.Errorf("expected an unreachable error but got %#v (%s)", d.ShadowErr, d.ShadowErr)
+		}
+
+		if stats := s.Stats(); stats.ErrorMismatches != 1 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+	})
+
+	t.Run("slow shadow registries do not add latency", func(t *testing.T) {
+		s := &ShadowRegistry{
+			Primary: registry{"my-service": {"localhost:4000"}},
+			Shadow: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+				<-ctx.Done()
+				return nil, 0, ctx.Err()
+			}),
+			Timeout: 100 * time.Millisecond,
+		}
+
+		start := time.Now()
+		s.Lookup(context.Background(), "my-service")
+
+		if elapsed := time.Since(start); elapsed >= s.Timeout {
+			t.Error("lookup took too long:", elapsed)
+		}
+
+		waitShadowLookups(t, s, 1)
+	})
+
+	t.Run("comparisons exceeding the concurrency limit are dropped", func(t *testing.T) {
+		release := make(chan struct{})
+
+		s := &ShadowRegistry{
+			Primary: registry{"my-service": {"localhost:4000"}},
+			Shadow: registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+				<-release
+				return []string{"localhost:4000"}, 0, nil
+			}),
+			MaxConcurrentLookups: 2,
+		}
+
+		for i := 0; i != 5; i++ {
+			s.Lookup(context.Background(), "my-service")
+		}
+
+		if stats := s.Stats(); stats.Drops != 3 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+
+		close(release)
+		waitShadowLookups(t, s, 2)
+
+		s.Lookup(context.Background(), "my-service")
+		waitShadowLookups(t, s, 3)
+	})
+}
+
+func waitShadowLookups(t *testing.T, s *ShadowRegistry, n int64) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); s.Stats().Lookups < n; {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for lookups on the shadow registry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
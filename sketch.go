@@ -0,0 +1,100 @@
+package services
+
+import "sync/atomic"
+
+// cacheSketch is a count-min sketch used to estimate how frequently keys are
+// looked up in a cache shard, as described in the TinyLFU paper:
+// https://arxiv.org/abs/1512.00727
+//
+// Counters saturate at 15 and are halved once the number of increments reaches
+// ten times the width of the sketch, so the estimates favor recent history.
+//
+// Counters are updated atomically, so lookups can increment them without
+// holding the shard mutex. Increments of saturated counters are not counted,
+// keys looked up all the time do not cause the counters to be halved faster.
+type cacheSketch struct {
+	rows  [4][]uint32
+	mask  uint64
+	count int64
+	reset int64
+}
+
+const cacheSketchMaxCount = 15
+
+func newCacheSketch(width int) *cacheSketch {
+	n := 16
+	for n < width {
+		n *= 2
+	}
+
+	s := &cacheSketch{
+		mask:  uint64(n - 1),
+		reset: int64(10 * n),
+	}
+
+	for i := range s.rows {
+		s.rows[i] = make([]uint32, n)
+	}
+
+	return s
+}
+
+func (s *cacheSketch) increment(hash uint64) {
+	incremented := false
+
+	for i := range s.rows {
+		c := &s.rows[i][s.index(hash, i)]
+
+		for {
+			n := atomic.LoadUint32(c)
+			if n >= cacheSketchMaxCount {
+				break
+			}
+			if atomic.CompareAndSwapUint32(c, n, n+1) {
+				incremented = true
+				break
+			}
+		}
+	}
+
+	if incremented && atomic.AddInt64(&s.count, +1) == s.reset {
+		s.halve()
+	}
+}
+
+func (s *cacheSketch) estimate(hash uint64) uint8 {
+	min := uint32(cacheSketchMaxCount)
+
+	for i := range s.rows {
+		if c := atomic.LoadUint32(&s.rows[i][s.index(hash, i)]); c < min {
+			min = c
+		}
+	}
+
+	return uint8(min)
+}
+
+func (s *cacheSketch) halve() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			c := &s.rows[i][j]
+			for n := atomic.LoadUint32(c); !atomic.CompareAndSwapUint32(c, n, n/2); {
+				n = atomic.LoadUint32(c)
+			}
+		}
+	}
+	atomic.AddInt64(&s.count, -s.reset/2)
+}
+
+// index returns the position of the counter for hash in the row i, mixing the
+// hash with a different seed for each row.
+func (s *cacheSketch) index(hash uint64, i int) uint64 {
+	seeds := [...]uint64{
+		0xc3a5c85c97cb3127,
+		0xb492b66fbe98f273,
+		0x9ae16a3b2f90404f,
+		0xcbf29ce484222325,
+	}
+	h := (hash + seeds[i]) * 0x9e3779b97f4a7c15
+	return (h >> 32) & s.mask
+}
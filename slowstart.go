@@ -0,0 +1,78 @@
+package services
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+// warmup records the addresses of item which are in their slow start window,
+// either because they were not in prev, or because their window started when
+// prev or an earlier entry was looked up.
+func (c *Cache) warmup(item *cacheItem, prev *cacheItem) {
+	if prev == nil || item.err != nil || len(item.addrs) == 0 {
+		return
+	}
+
+	window := c.slowStart(item.key.name)
+	if window <= 0 {
+		return
+	}
+
+	prevAddrs := make(map[string]struct{}, len(prev.addrs))
+	for _, addr := range prev.addrs {
+		prevAddrs[addr] = struct{}{}
+	}
+
+	now := time.Now()
+
+	for _, addr := range item.addrs {
+		since, warming := prev.warming[addr]
+
+		switch _, seen := prevAddrs[addr]; {
+		case warming && now.Sub(since) < window:
+		case !seen:
+			since = now
+		default:
+			continue
+		}
+
+		if item.warming == nil {
+			item.warming = make(map[string]time.Time)
+		}
+		item.warming[addr] = since
+	}
+
+	item.warmupTime = window
+}
+
+// warm returns the address that Resolve returns for item, given addr which was
+// picked first. If addr is in its slow start window, it is kept with a
+// probability proportional to the time elapsed since the window started, or
+// another address is picked.
+func (c *Cache) warm(ctx context.Context, item *cacheItem, picker Picker, addr string) string {
+	now := time.Now()
+
+	for i := 0; i != len(item.addrs); i++ {
+		since, warming := item.warming[addr]
+		if !warming {
+			break
+		}
+
+		elapsed := now.Sub(since)
+		if elapsed >= item.warmupTime || rand.Float64()*float64(item.warmupTime) < float64(elapsed) {
+			break
+		}
+
+		addr = picker.Pick(ctx)
+	}
+
+	return addr
+}
+
+func (c *Cache) slowStart(name string) time.Duration {
+	if c.SlowStartPolicy != nil {
+		return c.SlowStartPolicy(name)
+	}
+	return c.SlowStart
+}
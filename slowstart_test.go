@@ -0,0 +1,103 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheSlowStart(t *testing.T) {
+	mutex := sync.Mutex{}
+	addrs := []string{"localhost:4000"}
+
+	base := registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return copyStrings(addrs), 5 * time.Millisecond, nil
+	})
+
+	share := func(cache *Cache, addr string) float64 {
+		n := 0
+		for i := 0; i != 1000; i++ {
+			a, err := cache.Resolve(context.Background(), "my-service")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a == addr {
+				n++
+			}
+		}
+		return float64(n) / 1000
+	}
+
+	t.Run("new addresses receive a linearly increasing share of the traffic", func(t *testing.T) {
+		cache := &Cache{Registry: base, SlowStart: 500 * time.Millisecond}
+		defer cache.Close()
+
+		if _, err := cache.Resolve(context.Background(), "my-service"); err != nil {
+			t.Fatal(err)
+		}
+
+		mutex.Lock()
+		addrs = []string{"localhost:4000", "localhost:4001"}
+		mutex.Unlock()
+
+		time.Sleep(10 * time.Millisecond) // wait for the entry to expire
+
+		if r := share(cache, "localhost:4001"); r > 0.25 {
+			t.Errorf("the new address received %.1f%% of the traffic at the start of the window", 100*r)
+		}
+
+		time.Sleep(500 * time.Millisecond)
+
+		if r := share(cache, "localhost:4001"); r < 0.4 {
+			t.Errorf("the new address received %.1f%% of the traffic after the window", 100*r)
+		}
+	})
+
+	t.Run("addresses of the first lookup are not slowed down", func(t *testing.T) {
+		mutex.Lock()
+		addrs = []string{"localhost:4000", "localhost:4001"}
+		mutex.Unlock()
+
+		cache := &Cache{Registry: base, SlowStart: time.Minute}
+		defer cache.Close()
+
+		if r := share(cache, "localhost:4001"); r < 0.4 {
+			t.Errorf("the address received %.1f%% of the traffic", 100*r)
+		}
+	})
+
+	t.Run("the slow start policy is configured per service", func(t *testing.T) {
+		mutex.Lock()
+		addrs = []string{"localhost:4000"}
+		mutex.Unlock()
+
+		cache := &Cache{
+			Registry:  base,
+			SlowStart: time.Minute,
+			SlowStartPolicy: func(name string) time.Duration {
+				if name == "my-service" {
+					return 0
+				}
+				return time.Minute
+			},
+		}
+		defer cache.Close()
+
+		if _, err := cache.Resolve(context.Background(), "my-service"); err != nil {
+			t.Fatal(err)
+		}
+
+		mutex.Lock()
+		addrs = []string{"localhost:4000", "localhost:4001"}
+		mutex.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		if r := share(cache, "localhost:4001"); r < 0.4 {
+			t.Errorf("the new address received %.1f%% of the traffic with slow start disabled", 100*r)
+		}
+	})
+}
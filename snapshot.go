@@ -0,0 +1,196 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// cacheSnapshotVersion is the version of the format of cache snapshots, it
+// must be incremented when incompatible changes are made to the format.
+const cacheSnapshotVersion = 1
+
+type cacheSnapshot struct {
+	Version int                  `json:"version"`
+	Entries []cacheSnapshotEntry `json:"entries"`
+}
+
+type cacheSnapshotEntry struct {
+	Name    string         `json:"name"`
+	Tags    []string       `json:"tags,omitempty"`
+	Addrs   []string       `json:"addrs"`
+	Weights map[string]int `json:"weights,omitempty"`
+	Expires time.Time      `json:"expires"`
+}
+
+// WriteSnapshot writes a snapshot of the cache entries to w.
+//
+// The snapshot is a versioned JSON document listing the service names, tags,
+// addresses (and their weights, if the base registry exposes them) and
+// expiration times of the cache entries. Only entries which were
+// successfully looked up are written.
+func (c *Cache) WriteSnapshot(w io.Writer) error {
+	c.init()
+
+	snapshot := cacheSnapshot{
+		Version: cacheSnapshotVersion,
+		Entries: []cacheSnapshotEntry{},
+	}
+
+	for i := range c.shards {
+		shard := &c.shards[i]
+		shard.mutex.Lock()
+		for elem := shard.queue.Front(); elem != nil; elem = elem.Next() {
+			if item := elem.Value.(*cacheItem); item.isReady() && item.err == nil && len(item.addrs) != 0 {
+				snapshot.Entries = append(snapshot.Entries, cacheSnapshotEntry{
+					Name:    item.key.name,
+					Tags:    item.tags,
+					Addrs:   item.addrs,
+					Weights: item.weights,
+					Expires: item.ttl,
+				})
+			}
+		}
+		shard.mutex.Unlock()
+	}
+
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(snapshot)
+}
+
+// ReadSnapshot loads a snapshot previously written by WriteSnapshot from r.
+//
+// Entries loaded from the snapshot are considered stale, they are served until
+// a background lookup refreshes them, even if the base registry fails to
+// respond, for up to MaxSnapshotStale after they expired. Entries which expired
+// longer ago are skipped, and entries which already exist in the cache are not
+// overwritten.
+func (c *Cache) ReadSnapshot(r io.Reader) error {
+	c.init()
+	return c.readSnapshot(r)
+}
+
+func (c *Cache) readSnapshot(r io.Reader) error {
+	snapshot := cacheSnapshot{}
+
+	if err := json.NewDecoder(r).Decode(&snapshot); err != nil {
+		return err
+	}
+
+	if snapshot.Version != cacheSnapshotVersion {
+		return fmt.Errorf("unsupported cache snapshot version: %d", snapshot.Version)
+	}
+
+	now := time.Now()
+	maxStale := c.maxSnapshotStale()
+	if maxStale < c.MaxStaleOnError {
+		maxStale = c.MaxStaleOnError
+	}
+
+	for _, entry := range snapshot.Entries {
+		if !now.Before(entry.Expires.Add(maxStale)) {
+			continue
+		}
+
+		tags := sortedStrings(entry.Tags)
+		key := makeCacheKey(entry.Name, tags)
+		hash := key.hash()
+		shard := c.shard(hash)
+
+		item := newCacheItem(key, hash, tags)
+		item.set(entry.Addrs, entry.Expires.Sub(now), nil)
+		item.weights = entry.Weights
+		item.restored = true
+		item.filled = true
+		c.pick(item, nil)
+		close(item.ready)
+
+		shard.mutex.Lock()
+		_, exists := shard.items[key]
+		if !exists {
+			// Entries are written from the most to the least recently used,
+			// pushing them to the back of the queue preserves the order.
+			shard.items[key] = shard.queue.PushBack(item)
+			atomic.AddInt64(&c.size, +1)
+			item.bytes = item.sizeof()
+			c.grow(shard, nil, item.bytes)
+		}
+		shard.mutex.Unlock()
+		c.shrink(hash, nil)
+
+		if exists {
+			c.release(item, nil)
+		}
+	}
+
+	return nil
+}
+
+func (c *Cache) loadSnapshot(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		// No snapshot exists the first time the program starts.
+		if !os.IsNotExist(err) {
+			atomic.AddInt64(&c.snapshots, +1)
+		}
+		return
+	}
+	defer f.Close()
+
+	if err := c.readSnapshot(f); err != nil {
+		atomic.AddInt64(&c.snapshots, +1)
+	}
+}
+
+func (c *Cache) writeSnapshots(path string) {
+	defer c.join.Done()
+
+	ticker := time.NewTicker(c.snapshotInterval())
+	defer ticker.Stop()
+
+	for done := false; !done; {
+		select {
+		case <-ticker.C:
+		case <-c.ctx.Done():
+			done = true
+		}
+
+		if err := c.writeSnapshotFile(path); err != nil {
+			atomic.AddInt64(&c.snapshots, +1)
+		}
+	}
+}
+
+// writeSnapshotFile writes a snapshot of the cache to a temporary file which is
+// then renamed to path, so readers never see partially written snapshots.
+func (c *Cache) writeSnapshotFile(path string) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := c.WriteSnapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+func (c *Cache) snapshotInterval() time.Duration {
+	if interval := c.SnapshotInterval; interval > 0 {
+		return interval
+	}
+	return 1 * time.Minute
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	t.Run("entries loaded from a snapshot are served when the registry fails", func(t *testing.T) {
+		c1 := &Cache{Registry: registry{"my-service": {"localhost:4000"}}}
+		defer c1.Close()
+
+		if _, _, err := c1.Lookup(context.Background(), "my-service"); err != nil {
+			t.Fatal(err)
+		}
+
+		b := &bytes.Buffer{}
+		if err := c1.WriteSnapshot(b); err != nil {
+			t.Fatal(err)
+		}
+
+		c2 := &Cache{Registry: failingRegistry()}
+		defer c2.Close()
+
+		if err := c2.ReadSnapshot(b); err != nil {
+			t.Fatal(err)
+		}
+
+		assertCacheLookup(t, c2, "localhost:4000")
+		assertCacheLookup(t, c2, "localhost:4000")
+
+		if stats := c2.Stats(); stats.Size != 1 || stats.StaleHits != 2 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+	})
+
+	t.Run("entries loaded from a snapshot are refreshed", func(t *testing.T) {
+		c := &Cache{Registry: registry{"my-service": {"localhost:4001"}}}
+		defer c.Close()
+
+		err := c.ReadSnapshot(strings.NewReader(`{
+  "version": 1,
+  "entries": [{"name": "my-service", "addrs": ["localhost:4000"], "expires": "` + time.Now().Add(-time.Minute).Format(time.RFC3339) + `"}]
+}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assertCacheLookup(t, c, "localhost:4000")
+
+		for deadline := time.Now().Add(time.Second); c.Stats().Refreshes == 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("timeout waiting for the cache entry to be refreshed")
+			}
+			time.Sleep(time.Millisecond)
+		}
+
+		assertCacheLookup(t, c, "localhost:4001")
+	})
+
+	t.Run("entries loaded from a snapshot are not served past the maximum staleness", func(t *testing.T) {
+		c := &Cache{
+			Registry:         failingRegistry(),
+			MaxSnapshotStale: time.Hour,
+		}
+		defer c.Close()
+
+		err := c.ReadSnapshot(strings.NewReader(`{
+  "version": 1,
+  "entries": [
+    {"name": "my-service", "addrs": ["localhost:4000"], "expires": "` + time.Now().Add(-time.Hour+50*time.Millisecond).Format(time.RFC3339Nano) + `"},
+    {"name": "old-service", "addrs": ["localhost:4001"], "expires": "2006-01-02T15:04:05Z"}
+  ]
+}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stats := c.Stats(); stats.Size != 1 {
+			t.Errorf("entries which expired too long ago were loaded: %+v", stats)
+		}
+
+		assertCacheLookup(t, c, "localhost:4000")
+		time.Sleep(100 * time.Millisecond)
+
+		if _, _, err := c.Lookup(context.Background(), "my-service"); err == nil {
+			t.Error("the entry loaded from the snapshot was served past the maximum staleness")
+		}
+	})
+
+	t.Run("snapshots with an unsupported version are rejected", func(t *testing.T) {
+		c := &Cache{Registry: registry{}}
+		defer c.Close()
+
+		if err := c.ReadSnapshot(strings.NewReader(`{"version":42}`)); err == nil {
+			t.Error("expected an error but got nil")
+		}
+	})
+
+	t.Run("snapshots are written to and loaded from the snapshot path", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "services")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "cache.json")
+
+		c1 := &Cache{
+			Registry:     registry{"my-service": {"localhost:4000"}},
+			SnapshotPath: path,
+		}
+		assertCacheLookup(t, c1, "localhost:4000")
+		c1.Close()
+
+		c2 := &Cache{
+			Registry:     failingRegistry(),
+			SnapshotPath: path,
+		}
+		defer c2.Close()
+		assertCacheLookup(t, c2, "localhost:4000")
+	})
+
+	t.Run("snapshots which fail to be loaded or written are counted", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "services")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		path := filepath.Join(dir, "cache.json")
+
+		if err := ioutil.WriteFile(path, []byte(`{"version":42}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		c1 := &Cache{Registry: registry{}, SnapshotPath: path}
+		c1.Lookup(context.Background(), "my-service")
+		c1.Close()
+
+		if stats := c1.Stats(); stats.SnapshotErrors != 1 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+
+		c2 := &Cache{Registry: registry{}, SnapshotPath: filepath.Join(dir, "missing", "cache.json")}
+		c2.Lookup(context.Background(), "my-service")
+		c2.Close()
+
+		if stats := c2.Stats(); stats.SnapshotErrors != 1 {
+			t.Errorf("bad stats: %+v", stats)
+		}
+	})
+}
+
+func failingRegistry() Registry {
+	return registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+		return nil, 0, errors.New("failed")
+	})
+}
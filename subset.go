@@ -0,0 +1,85 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// SubsetRegistry is an implementation of the Registry interface which returns
+// a deterministic subset of the addresses of services, so each client only
+// connects to a fraction of the instances of large services.
+//
+// Subsets are computed with the algorithm described in the Site Reliability
+// Engineering book (chapter 20, "Deterministic subsetting"): clients are
+// grouped in rounds, each round spreading its clients over a different order
+// of the addresses, so every address is used by the same number of clients
+// when the client IDs are consecutive integers.
+//
+// The subset only depends on the set of addresses returned by the base
+// registry, not their order, so it is stable across refreshes. The order of
+// addresses in each round is given by hashing them, so when instances come and
+// go, subsets only change by a few addresses, unless the number of subsets per
+// round changes, which moves clients to different rounds.
+type SubsetRegistry struct {
+	// Base registry to lookup addresses from. This field must not be nil.
+	Registry Registry
+
+	// Identifier of the client, clients should use consecutive integers
+	// starting at zero for the load to be evenly spread across addresses.
+	ClientID int
+
+	// Number of addresses returned for each service. If the service has
+	// fewer addresses, all of them are returned. Zero disables subsetting.
+	SubsetSize int
+}
+
+// Lookup satisfies the Registry interface.
+func (s *SubsetRegistry) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+	addrs, ttl, err := s.Registry.Lookup(ctx, name, tags...)
+	if err != nil {
+		return addrs, ttl, err
+	}
+	return subset(name, addrs, s.ClientID, s.SubsetSize), ttl, nil
+}
+
+// subset returns the subset of addrs used by the client with the given ID.
+func subset(name string, addrs []string, clientID int, size int) []string {
+	if size <= 0 || len(addrs) <= size {
+		return addrs
+	}
+
+	if clientID < 0 {
+		clientID = -clientID
+	}
+
+	count := len(addrs) / size
+	round := clientID / count
+	seed := mix64(hashString(name) ^ uint64(round))
+
+	ordered := make([]subsetAddr, len(addrs))
+	for i, addr := range addrs {
+		ordered[i] = subsetAddr{addr: addr, rank: mix64(hashString(addr) ^ seed)}
+	}
+
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].rank != ordered[j].rank {
+			return ordered[i].rank < ordered[j].rank
+		}
+		return ordered[i].addr < ordered[j].addr
+	})
+
+	start := (clientID % count) * size
+	result := make([]string, size)
+
+	for i := range result {
+		result[i] = ordered[start+i].addr
+	}
+
+	return result
+}
+
+type subsetAddr struct {
+	addr string
+	rank uint64
+}
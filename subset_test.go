@@ -0,0 +1,86 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestSubsetRegistry(t *testing.T) {
+	addrs := testAddrs(100)
+
+	lookup := func(r Registry) []string {
+		subset, _, err := r.Lookup(context.Background(), "my-service")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return subset
+	}
+
+	t.Run("subsets are evenly spread across addresses", func(t *testing.T) {
+		counts := make(map[string]int)
+
+		for id := 0; id != 50; id++ {
+			subset := lookup(&SubsetRegistry{
+				Registry:   registry{"my-service": addrs},
+				ClientID:   id,
+				SubsetSize: 10,
+			})
+
+			if len(subset) != 10 {
+				t.Fatalf("client %d: bad subset size: %d", id, len(subset))
+			}
+
+			for _, addr := range subset {
+				counts[addr]++
+			}
+		}
+
+		// 50 clients make 5 rounds of 10 subsets of 10 addresses, each round
+		// covers all the addresses.
+		for _, addr := range addrs {
+			if counts[addr] != 5 {
+				t.Errorf("%s is used by %d clients instead of 5", addr, counts[addr])
+			}
+		}
+	})
+
+	t.Run("subsets do not depend on the order of addresses", func(t *testing.T) {
+		s1 := lookup(&SubsetRegistry{Registry: registry{"my-service": addrs}, ClientID: 42, SubsetSize: 10})
+		s2 := lookup(&SubsetRegistry{Registry: registry{"my-service": shuffledStrings(addrs)}, ClientID: 42, SubsetSize: 10})
+
+		if !reflect.DeepEqual(s1, s2) {
+			t.Errorf("subsets differ:\n%v\n%v", s1, s2)
+		}
+	})
+
+	t.Run("removing an address changes few addresses of subsets", func(t *testing.T) {
+		// With 105 and 104 addresses, there are 10 subsets per round in both
+		// cases, so clients remain in the same round.
+		addrs := testAddrs(105)
+
+		for id := 0; id != 50; id++ {
+			s1 := lookup(&SubsetRegistry{Registry: registry{"my-service": addrs}, ClientID: id, SubsetSize: 10})
+			s2 := lookup(&SubsetRegistry{Registry: registry{"my-service": addrs[1:]}, ClientID: id, SubsetSize: 10})
+
+			if n := len(diffStrings(s2, s1)); n > 1 {
+				t.Errorf("client %d: %d addresses changed", id, n)
+			}
+		}
+	})
+
+	t.Run("all addresses are returned when there are fewer than the subset size", func(t *testing.T) {
+		subset := lookup(&SubsetRegistry{Registry: registry{"my-service": addrs[:5]}, ClientID: 1, SubsetSize: 10})
+
+		if !reflect.DeepEqual(subset, addrs[:5]) {
+			t.Error("bad subset:", subset)
+		}
+	})
+
+	t.Run("errors are returned", func(t *testing.T) {
+		_, _, err := (&SubsetRegistry{Registry: registry{}, SubsetSize: 10}).Lookup(context.Background(), "my-service")
+		if !isUnreachable(err) {
+			t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UnionRegistry is an implementation of the Registry interface which queries
+// multiple registries concurrently and merges their results.
+//
+// This is useful during migrations from one service discovery system to
+// another, when instances of the same service may be registered in either of
+// them.
+//
+// The addresses returned by the registries are deduplicated, and the TTL of
+// the result is the minimum of the TTLs returned by the registries that
+// succeeded.
+type UnionRegistry struct {
+	// List of registries to merge the results of.
+	Registries []Registry
+
+	// When ReportErrors is true, errors of registries that failed are
+	// aggregated and returned alongside the addresses from the ones that
+	// succeeded. By default, errors are only returned if all registries
+	// failed.
+	//
+	// Those partial errors are never reported as unreachable or canceled, but
+	// Cache, like most consumers of registries, treats any error as a failed
+	// lookup and discards the addresses, so ReportErrors should only be set
+	// when the program inspects the results of the union directly.
+	ReportErrors bool
+}
+
+// Lookup satisfies the Registry interface.
+func (u *UnionRegistry) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	results := make([]unionResult, len(u.Registries))
+	wg := sync.WaitGroup{}
+
+	for i, r := range u.Registries {
+		wg.Add(1)
+		go func(res *unionResult, r Registry) {
+			defer wg.Done()
+			res.addrs, res.ttl, res.err = r.Lookup(ctx, name, tags...)
+		}(&results[i], r)
+	}
+
+	wg.Wait()
+
+	var addrs []string
+	var errs []error
+	var seen = make(map[string]struct{})
+	var ttl time.Duration
+	var ok bool
+
+	for _, res := range results {
+		if res.err != nil {
+			errs = append(errs, res.err)
+			continue
+		}
+
+		if !ok || res.ttl < ttl {
+			ttl = res.ttl
+		}
+		ok = true
+
+		for _, addr := range res.addrs {
+			if _, dup := seen[addr]; !dup {
+				seen[addr] = struct{}{}
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	switch {
+	case len(u.Registries) == 0:
+		return nil, 0, &unionError{name: name}
+	case !ok:
+		return nil, 0, &unionError{name: name, errs: errs}
+	case u.ReportErrors && len(errs) != 0:
+		return addrs, ttl, &unionError{name: name, errs: errs, partial: true}
+	default:
+		return addrs, ttl, nil
+	}
+}
+
+type unionResult struct {
+	addrs []string
+	ttl   time.Duration
+	err   error
+}
+
+type unionError struct {
+	name    string
+	errs    []error
+	partial bool // some registries succeeded
+}
+
+func (e *unionError) Error() string {
+	if len(e.errs) == 0 {
+		return e.name + ": no registries to query"
+	}
+	s := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		s[i] = err.Error()
+	}
+	return e.name + ": " + strings.Join(s, "; ")
+}
+
+// Errors returns the list of errors that were aggregated.
+func (e *unionError) Errors() []error { return e.errs }
+
+func (e *unionError) Canceled() bool { return !e.partial && e.all(isCanceled) }
+
+func (e *unionError) Timeout() bool { return e.any(isTimeout) }
+
+func (e *unionError) Temporary() bool { return e.any(isTemporary) }
+
+func (e *unionError) Unreachable() bool { return !e.partial && e.all(isUnreachable) }
+
+func (e *unionError) Validation() bool { return e.any(isValidation) }
+
+func (e *unionError) all(f func(error) bool) bool {
+	for _, err := range e.errs {
+		if !f(err) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *unionError) any(f func(error) bool) bool {
+	for _, err := range e.errs {
+		if f(err) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestUnionRegistry(t *testing.T) {
+	t.Run("resolver", func(t *testing.T) {
+		testResolver(t, func(services map[string][]string) (Resolver, func()) {
+			r1 := registry{}
+			r2 := registry{}
+
+			// Split the addresses of each service between the two registries.
+			for name, addrs := range services {
+				r1[name] = addrs[:len(addrs)/2]
+				r2[name] = addrs[len(addrs)/2:]
+			}
+
+			return &Cache{
+				Registry: &UnionRegistry{
+					Registries: []Registry{r1, r2},
+				},
+			}, func() {}
+		})
+	})
+
+	t.Run("addresses are merged and deduplicated", func(t *testing.T) {
+		u := &UnionRegistry{
+			Registries: []Registry{
+				registry{"my-service": {"localhost:4000", "localhost:4001"}},
+				registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+					return []string{"localhost:4001", "localhost:4002"}, 100 * time.Millisecond, nil
+				}),
+			},
+		}
+
+		addrs, ttl, err := u.Lookup(context.Background(), "my-service")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(addrs)
+
+		if !reflect.DeepEqual(addrs, []string{"localhost:4000", "localhost:4001", "localhost:4002"}) {
+			t.Error("bad addresses:", addrs)
+		}
+
+		if ttl != 100*time.Millisecond {
+			t.Error("bad TTL:", ttl)
+		}
+	})
+
+	t.Run("partial failures are tolerated", func(t *testing.T) {
+		for _, reportErrors := range []bool{false, true} {
+			u := &UnionRegistry{
+				Registries: []Registry{
+					registry{"my-service": {"localhost:4000"}},
+					registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+						return nil, 0, errors.New("failed")
+					}),
+				},
+				ReportErrors: reportErrors,
+			}
+
+			addrs, _, err := u.Lookup(context.Background(), "my-service")
+
+			if !reflect.DeepEqual(addrs, []string{"localhost:4000"}) {
+				t.Error("bad addresses:", addrs)
+			}
+
+			if reportErrors != (err != nil) {
+				t.Errorf("bad error (report errors = %t): %v", reportErrors, err)
+			}
+		}
+	})
+
+	t.Run("partial errors are not reported as unreachable", func(t *testing.T) {
+		u := &UnionRegistry{
+			Registries:   []Registry{registry{"my-service": {"localhost:4000"}}, registry{}},
+			ReportErrors: true,
+		}
+
+		addrs, _, err := u.Lookup(context.Background(), "my-service")
+		if err == nil || isUnreachable(err) {
+			t.Errorf("expected an error which is not unreachable but got %#v (%v)", err, err)
+		}
+
+		if !reflect.DeepEqual(addrs, []string{"localhost:4000"}) {
+			t.Error("bad addresses:", addrs)
+		}
+
+		f := &FallbackRegistry{Registries: []Registry{u, registry{"my-service": {"localhost:4001"}}}}
+
+		if addrs, _, _ := f.Lookup(context.Background(), "my-service"); !reflect.DeepEqual(addrs, []string{"localhost:4000"}) {
+			t.Error("the addresses of the union were discarded by the fallback:", addrs)
+		}
+	})
+
+	t.Run("partial errors are lookup failures for caches", func(t *testing.T) {
+		c := &Cache{
+			Registry: &UnionRegistry{
+				Registries:   []Registry{registry{"my-service": {"localhost:4000"}}, registry{}},
+				ReportErrors: true,
+			},
+		}
+		defer c.Close()
+
+		if _, _, err := c.Lookup(context.Background(), "my-service"); err == nil {
+			t.Error("expected an error but got none")
+		}
+	})
+
+	t.Run("errors of canceled lookups are reported as canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		canceled := registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+			cancel()
+			return nil, 0, context.Canceled
+		})
+
+		u := &UnionRegistry{Registries: []Registry{canceled, canceled}}
+
+		if _, _, err := u.Lookup(ctx, "my-service"); !isCanceled(err) {
+			t.Errorf("expected a canceled error but got %#v (%s)", err, err)
+		}
+	})
+
+	t.Run("an unreachable error is returned when all registries fail", func(t *testing.T) {
+		u := &UnionRegistry{
+			Registries: []Registry{registry{}, registry{}},
+		}
+
+		_, _, err := u.Lookup(context.Background(), "my-service")
+		if !isUnreachable(err) {
+			t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+		}
+	})
+}
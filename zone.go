@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+)
+
+// ZoneRegistry is an implementation of the Registry interface which prefers
+// exposing the addresses of services located in the same zone as the program,
+// as long as there are enough of them.
+//
+// Unlike Prefer, which falls back to other tags only when no addresses match
+// the preferred one, the registry only returns the addresses of the local zone
+// when they make up at least MinCount addresses and MinFraction of the
+// addresses of the service across all zones. Otherwise all the addresses are
+// returned, so traffic spills over to other zones in proportion to their
+// number of instances, and the surviving local instances are not overloaded.
+//
+// Zones are expected to be exposed as tags by the base registry, the addresses
+// of the local zone are those returned when looking up the service with the
+// name of the zone added to the tags.
+type ZoneRegistry struct {
+	// Base registry to lookup addresses from. This field must not be nil.
+	Registry Registry
+
+	// Name of the zone that the program runs in. If empty, it is read from
+	// the environment variable named by ZoneEnv, and if the zone is still
+	// unknown, lookups are forwarded to the base registry.
+	Zone string
+
+	// Name of the environment variable that the local zone is read from when
+	// Zone is empty. Defaults to SERVICES_ZONE.
+	ZoneEnv string
+
+	// LookupEnv is the function used to read environment variables. Defaults
+	// to os.LookupEnv.
+	LookupEnv func(string) (string, bool)
+
+	// Minimum number of addresses (at least 1), and minimum fraction of the
+	// addresses of the service, between 0 and 1, that the local zone must
+	// have for the registry to only return its addresses.
+	MinCount    int
+	MinFraction float64
+}
+
+// Lookup satisfies the Registry interface.
+func (z *ZoneRegistry) Lookup(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+	zone := z.zone()
+	if zone == "" {
+		return z.Registry.Lookup(ctx, name, tags...)
+	}
+
+	zoneTags := make([]string, len(tags)+1)
+	copy(zoneTags, tags)
+	zoneTags[len(tags)] = zone
+
+	local, localTTL, err := z.Registry.Lookup(ctx, name, zoneTags...)
+	if isCanceled(err) {
+		return nil, 0, err
+	}
+	if err != nil {
+		local = nil
+	}
+
+	if len(local) < z.minCount() {
+		return z.Registry.Lookup(ctx, name, tags...)
+	}
+
+	if z.MinFraction <= 0 {
+		return local, localTTL, nil
+	}
+
+	all, ttl, err := z.Registry.Lookup(ctx, name, tags...)
+	if err != nil {
+		// The local addresses are still better than no addresses at all.
+		if isCanceled(err) {
+			return nil, 0, err
+		}
+		return local, localTTL, nil
+	}
+
+	if localTTL < ttl {
+		ttl = localTTL
+	}
+
+	if float64(len(local)) >= z.MinFraction*float64(len(all)) {
+		return local, ttl, nil
+	}
+
+	return all, ttl, nil
+}
+
+func (z *ZoneRegistry) zone() string {
+	if zone := z.Zone; zone != "" {
+		return zone
+	}
+
+	lookupEnv := z.LookupEnv
+	if lookupEnv == nil {
+		lookupEnv = os.LookupEnv
+	}
+
+	zoneEnv := z.ZoneEnv
+	if zoneEnv == "" {
+		zoneEnv = "SERVICES_ZONE"
+	}
+
+	zone, _ := lookupEnv(zoneEnv)
+	return strings.TrimSpace(zone)
+}
+
+func (z *ZoneRegistry) minCount() int {
+	if n := z.MinCount; n > 1 {
+		return n
+	}
+	return 1
+}
@@ -0,0 +1,124 @@
+package services
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestZoneRegistry(t *testing.T) {
+	zones := map[string][]string{
+		"zone-a": {"10.0.0.1:4242"},
+		"zone-b": {"10.0.1.1:4242", "10.0.1.2:4242"},
+		"zone-c": {"10.0.2.1:4242", "10.0.2.2:4242", "10.0.2.3:4242"},
+	}
+
+	base := registryFunc(func(ctx context.Context, name string, tags ...string) ([]string, time.Duration, error) {
+		if name != "my-service" {
+			return nil, time.Second, unreachable{}
+		}
+
+		var addrs []string
+		for zone, zoneAddrs := range zones {
+			if len(tags) == 0 || tags[len(tags)-1] == zone {
+				addrs = append(addrs, zoneAddrs...)
+			}
+		}
+		return addrs, time.Second, nil
+	})
+
+	tests := []struct {
+		scenario string
+		registry *ZoneRegistry
+		addrs    []string
+	}{
+		{
+			scenario: "without a local zone, all addresses are returned",
+			registry: &ZoneRegistry{Registry: base, LookupEnv: envMap{}.lookupEnv},
+			addrs:    sortedStrings(append(append(copyStrings(zones["zone-a"]), zones["zone-b"]...), zones["zone-c"]...)),
+		},
+
+		{
+			scenario: "without thresholds, the addresses of the local zone are returned",
+			registry: &ZoneRegistry{Registry: base, Zone: "zone-a"},
+			addrs:    zones["zone-a"],
+		},
+
+		{
+			scenario: "the local zone is read from the environment",
+			registry: &ZoneRegistry{Registry: base, LookupEnv: envMap{"SERVICES_ZONE": "zone-b"}.lookupEnv},
+			addrs:    zones["zone-b"],
+		},
+
+		{
+			scenario: "the name of the environment variable is configurable",
+			registry: &ZoneRegistry{Registry: base, ZoneEnv: "AZ", LookupEnv: envMap{"AZ": "zone-c"}.lookupEnv},
+			addrs:    zones["zone-c"],
+		},
+
+		{
+			scenario: "the local zone is returned when it has the minimum number of addresses",
+			registry: &ZoneRegistry{Registry: base, Zone: "zone-b", MinCount: 2},
+			addrs:    zones["zone-b"],
+		},
+
+		{
+			scenario: "all addresses are returned when the local zone has fewer than the minimum number of addresses",
+			registry: &ZoneRegistry{Registry: base, Zone: "zone-a", MinCount: 2},
+			addrs:    sortedStrings(append(append(copyStrings(zones["zone-a"]), zones["zone-b"]...), zones["zone-c"]...)),
+		},
+
+		{
+			scenario: "the local zone is returned when it has the minimum fraction of addresses",
+			registry: &ZoneRegistry{Registry: base, Zone: "zone-c", MinFraction: 0.5},
+			addrs:    zones["zone-c"],
+		},
+
+		{
+			scenario: "all addresses are returned when the local zone has less than the minimum fraction of addresses",
+			registry: &ZoneRegistry{Registry: base, Zone: "zone-b", MinFraction: 0.5},
+			addrs:    sortedStrings(append(append(copyStrings(zones["zone-a"]), zones["zone-b"]...), zones["zone-c"]...)),
+		},
+
+		{
+			scenario: "all addresses are returned when the local zone has no addresses",
+			registry: &ZoneRegistry{Registry: base, Zone: "zone-d"},
+			addrs:    sortedStrings(append(append(copyStrings(zones["zone-a"]), zones["zone-b"]...), zones["zone-c"]...)),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.scenario, func(t *testing.T) {
+			addrs, ttl, err := test.registry.Lookup(context.Background(), "my-service")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(sortedStrings(addrs), sortedStrings(test.addrs)) {
+				t.Errorf("bad addresses:\n%v\n%v", addrs, test.addrs)
+			}
+
+			if ttl != time.Second {
+				t.Error("bad TTL:", ttl)
+			}
+		})
+	}
+
+	t.Run("errors of the base registry are returned", func(t *testing.T) {
+		_, _, err := (&ZoneRegistry{Registry: base, Zone: "zone-a"}).Lookup(context.Background(), "other-service")
+		if !isUnreachable(err) {
+			t.Errorf("expected an unreachable error but got %#v (%s)", err, err)
+		}
+	})
+
+	t.Run("canceled lookups return a canceled error", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		_, _, err := (&ZoneRegistry{Registry: registry{}, Zone: "zone-a"}).Lookup(ctx, "my-service")
+		if !isCanceled(err) {
+			t.Errorf("expected a canceled error but got %#v (%s)", err, err)
+		}
+	})
+}